@@ -0,0 +1,155 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+
+	// channelWaitTimeout is how long publishers wait for a lost connection to come back
+	channelWaitTimeout = 10 * time.Second
+)
+
+// reconnectDelay doubles the delay with every attempt up to reconnectMaxDelay.
+// Half of the delay is random so that services restarted together do not
+// reconnect at the same moment.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectBaseDelay
+	for i := 1; i < attempt && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, reconnectMaxDelay)
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// setConnection makes conn the current connection and watches it for failures
+func (s *RabbitMQService) setConnection(conn *amqp.Connection) {
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conn = conn
+	close(s.ready)
+	s.mu.Unlock()
+
+	go s.watch(closed)
+}
+
+// watch waits for the connection to close and reconnects unless the service was closed
+func (s *RabbitMQService) watch(closed <-chan *amqp.Error) {
+	amqpErr := <-closed
+	if amqpErr == nil {
+		// Closed by Close
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.conn = nil
+	s.ready = make(chan struct{})
+	s.mu.Unlock()
+
+	log.Printf("Connection to RabbitMQ lost: %v", amqpErr)
+	s.reconnect()
+}
+
+// reconnect dials RabbitMQ until it succeeds or the service is closed
+func (s *RabbitMQService) reconnect() {
+	for attempt := 1; ; attempt++ {
+		delay := reconnectDelay(attempt)
+		log.Printf("Reconnecting to RabbitMQ in %v, attempt %d", delay, attempt)
+
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return
+		}
+
+		conn, err := amqp.Dial(s.url)
+		if err != nil {
+			log.Printf("Reconnection to RabbitMQ failed: %v", err)
+			continue
+		}
+
+		log.Printf("[x] Reconnected to RabbitMQ")
+		s.setConnection(conn)
+		return
+	}
+}
+
+// waitConnection blocks until a connection is available. It returns false once
+// ctx is canceled or the service is closed.
+func (s *RabbitMQService) waitConnection(ctx context.Context) (*amqp.Connection, bool) {
+	for {
+		s.mu.Lock()
+		conn, ready := s.conn, s.ready
+		closed := s.closed
+		s.mu.Unlock()
+
+		if closed || ctx.Err() != nil {
+			return nil, false
+		}
+		if conn != nil {
+			return conn, true
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, false
+		case <-s.done:
+			return nil, false
+		}
+	}
+}
+
+// channel opens a channel on the current connection, waiting up to channelWaitTimeout
+// or until ctx is done while the service reconnects
+func (s *RabbitMQService) channel(ctx context.Context) (*amqp.Channel, error) {
+	timeout := time.NewTimer(channelWaitTimeout)
+	defer timeout.Stop()
+
+	for {
+		s.mu.Lock()
+		conn, ready := s.conn, s.ready
+		closed := s.closed
+		s.mu.Unlock()
+
+		if closed {
+			return nil, fmt.Errorf("failed to open a channel: service is closed")
+		}
+
+		if conn != nil {
+			ch, err := conn.Channel()
+			if err != nil {
+				return nil, fmt.Errorf("failed to open a channel: %v", err)
+			}
+			return ch, nil
+		}
+
+		select {
+		case <-ready:
+		case <-s.done:
+		case <-timeout.C:
+			return nil, fmt.Errorf("failed to open a channel: not connected to RabbitMQ")
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to open a channel: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ConsumeOptions controls how many messages a consumer handles at the same time
+type ConsumeOptions struct {
+	// Prefetch is the number of unacknowledged messages the broker sends to the consumer
+	Prefetch int
+
+	// Workers is the number of workerFunc goroutines handling the messages
+	Workers int
+
+	// Key returns the key messages are partitioned by. Messages with the same
+	// key are handled by the same worker in the order they were delivered.
+	Key func(amqp.Delivery) string
+}
+
+// DefaultConsumeOptions handles one message at a time
+var DefaultConsumeOptions = ConsumeOptions{
+	Prefetch: 1,
+	Workers:  1,
+	Key:      OrderKey,
+}
+
+// withDefaults fills in the options that are not set. The prefetch is at least
+// the number of workers, otherwise some workers would never get a message.
+func (o ConsumeOptions) withDefaults() ConsumeOptions {
+	if o.Workers < 1 {
+		o.Workers = DefaultConsumeOptions.Workers
+	}
+	if o.Prefetch < o.Workers {
+		o.Prefetch = o.Workers
+	}
+	if o.Key == nil {
+		o.Key = DefaultConsumeOptions.Key
+	}
+	return o
+}
+
+// OrderKey partitions payment requests and responses by order id, falling
+// back to the correlation id for messages that cannot be decoded
+func OrderKey(d amqp.Delivery) string {
+	var message struct {
+		OrderID string `json:"orderId"`
+	}
+	if err := json.Unmarshal(d.Body, &message); err != nil || message.OrderID == "" {
+		return d.CorrelationId
+	}
+	return message.OrderID
+}
+
+// startWorkers starts the workers of a consumer and returns the channel the
+// consumer sends its deliveries to. Closing the channel stops the workers once
+// they handled the deliveries they were given, wait blocks until then.
+func startWorkers(opts ConsumeOptions, workerFunc func(<-chan amqp.Delivery)) (deliveries chan<- amqp.Delivery, wait func()) {
+	var wg sync.WaitGroup
+	run := func(msgs <-chan amqp.Delivery) {
+		defer wg.Done()
+		workerFunc(msgs)
+	}
+
+	if opts.Workers == 1 {
+		msgs := make(chan amqp.Delivery)
+		wg.Add(1)
+		go run(msgs)
+		return msgs, wg.Wait
+	}
+
+	// Every worker can buffer up to the prefetch count, so a slow message
+	// does not hold back the deliveries of the other workers
+	partitions := make([]chan amqp.Delivery, opts.Workers)
+	wg.Add(len(partitions))
+	for i := range partitions {
+		partitions[i] = make(chan amqp.Delivery, opts.Prefetch)
+		go run(partitions[i])
+	}
+
+	msgs := make(chan amqp.Delivery)
+	go func() {
+		for d := range msgs {
+			h := fnv.New32a()
+			h.Write([]byte(opts.Key(d)))
+			partitions[h.Sum32()%uint32(len(partitions))] <- d
+		}
+
+		for _, partition := range partitions {
+			close(partition)
+		}
+	}()
+
+	return msgs, wg.Wait
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers added to messages that are retried or dead-lettered
+const (
+	RetryCountHeader    = "x-retry-count"
+	FailureReasonHeader = "x-failure-reason"
+	OriginalQueueHeader = "x-original-queue"
+	FailedAtHeader      = "x-failed-at"
+)
+
+// DeadLetterExchange is the direct exchange dead-lettered messages are published to,
+// routed to the dead letter queue of their original queue by the queue name
+const DeadLetterExchange = "dead-letters"
+
+// RetryPolicy controls how often a failed message is delivered again before
+// it is moved to the dead letter queue
+type RetryPolicy struct {
+	MaxRetries int
+	Delay      time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	Delay:      5 * time.Second,
+}
+
+// RetryQueueName is the queue messages wait in before they are delivered again
+func RetryQueueName(queueName string) string {
+	return queueName + ".retry"
+}
+
+// DeadLetterQueueName is the queue permanently failing messages of queueName are parked in
+func DeadLetterQueueName(queueName string) string {
+	return queueName + ".dlq"
+}
+
+func isDeadLetterQueue(queueName string) bool {
+	return strings.HasSuffix(queueName, DeadLetterQueueName(""))
+}
+
+// RetryCount returns how many times the message was retried
+func RetryCount(d amqp.Delivery) int {
+	switch v := d.Headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+// failedHeaders copies the headers of a failed message and records why and where it failed
+func failedHeaders(queueName string, d amqp.Delivery, retries int, reason error) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	headers[RetryCountHeader] = int32(retries)
+	headers[OriginalQueueHeader] = queueName
+	headers[FailedAtHeader] = time.Now().UTC()
+	if reason != nil {
+		headers[FailureReasonHeader] = reason.Error()
+	}
+	return headers
+}
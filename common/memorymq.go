@@ -0,0 +1,475 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// MemoryMQService is an in-process message broker implementing MqSvc.
+// It follows the RabbitMQ semantics the services rely on: durable named
+// queues bound to a direct or topic exchange, ReplyTo and CorrelationId,
+// manual ack with a prefetch count per consumer, and redelivery of nacked
+// or rejected messages.
+// Retried messages are delivered again after the retry delay and dead-lettered
+// messages are parked in the dead letter queue of their queue.
+// It is meant for running both services in a single process in tests.
+type MemoryMQService struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	exchange Exchange
+	queues   map[string][]amqp.Delivery
+	// bindings holds the routing keys each queue is bound to the exchange with
+	bindings map[string][]string
+	unacked  map[uint64]*memoryDelivery
+	nextTag  uint64
+	closed   bool
+	done     chan struct{}
+
+	retry RetryPolicy
+	// delayed counts retried messages waiting for the retry delay
+	delayed int
+}
+
+// memoryDelivery is a message handed to a consumer and waiting for an ack
+type memoryDelivery struct {
+	queue    string
+	delivery amqp.Delivery
+	consumer *memoryConsumer
+}
+
+type memoryConsumer struct {
+	prefetch int
+	inFlight int
+}
+
+// NewMemoryMQService creates a new in-process broker routing messages like exchange
+func NewMemoryMQService(exchange Exchange) *MemoryMQService {
+	s := &MemoryMQService{
+		exchange: exchange,
+		queues:   make(map[string][]amqp.Delivery),
+		bindings: make(map[string][]string),
+		unacked:  make(map[uint64]*memoryDelivery),
+		done:     make(chan struct{}),
+		retry:    DefaultRetryPolicy,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Close stops all consumers. Like closing an AMQP channel, unacknowledged
+// messages are put back on their queues.
+func (s *MemoryMQService) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+
+	for tag, pending := range s.unacked {
+		s.requeue(pending)
+		delete(s.unacked, tag)
+	}
+	s.cond.Broadcast()
+}
+
+// Publish puts a message on every queue bound to the routing key, declaring the
+// queue named by the routing key if needed
+func (s *MemoryMQService) Publish(ctx context.Context, routingKey string, body []byte, replyQueueName string, requestId string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish a message: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("failed to publish a message: broker is closed")
+	}
+	s.declare(routingKey)
+
+	delivery := amqp.Delivery{
+		ContentType:   "application/json",
+		ReplyTo:       replyQueueName,
+		CorrelationId: requestId,
+		Timestamp:     time.Now().UTC(),
+		Exchange:      s.exchange.Name,
+		RoutingKey:    routingKey,
+		Body:          append([]byte(nil), body...),
+	}
+
+	for _, queueName := range s.route(routingKey) {
+		s.queues[queueName] = append(s.queues[queueName], delivery)
+	}
+	s.cond.Broadcast()
+
+	return nil
+}
+
+// Consume delivers messages of the named queue to the workers and blocks until ctx is
+// canceled or the broker is closed. After ctx is canceled it waits for the workers to
+// handle the messages they were given.
+func (s *MemoryMQService) Consume(ctx context.Context, queueName string, opts ConsumeOptions, workerFunc func(<-chan amqp.Delivery)) error {
+	opts = opts.withDefaults()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to register a consumer: broker is closed")
+	}
+	s.declare(queueName)
+	s.mu.Unlock()
+
+	// Wake up the dispatcher when ctx is canceled
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+
+	msgs, wait := startWorkers(opts, workerFunc)
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		s.dispatch(ctx, queueName, &memoryConsumer{prefetch: opts.Prefetch}, msgs)
+	}()
+
+	select {
+	case <-ctx.Done():
+		<-dispatched
+		wait()
+	case <-s.done:
+	}
+
+	return nil
+}
+
+// Bind binds the named queue to the exchange with routingKey
+func (s *MemoryMQService) Bind(ctx context.Context, queueName string, routingKey string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to bind queue %s: %w", queueName, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exchange.Name == "" {
+		return fmt.Errorf("failed to bind queue %s: no exchange configured", queueName)
+	}
+	s.declare(queueName)
+	s.bindings[queueName] = append(s.bindings[queueName], routingKey)
+
+	return nil
+}
+
+// declare creates a queue bound with its own name, must be called with the lock held
+func (s *MemoryMQService) declare(queueName string) {
+	if _, ok := s.queues[queueName]; !ok {
+		s.queues[queueName] = nil
+	}
+	if _, ok := s.bindings[queueName]; !ok {
+		s.bindings[queueName] = []string{queueName}
+	}
+}
+
+// route returns the queues a message with routingKey is delivered to, must be called with the lock held
+func (s *MemoryMQService) route(routingKey string) []string {
+	if s.exchange.Name == "" {
+		return []string{routingKey}
+	}
+
+	var queues []string
+	for queueName, keys := range s.bindings {
+		for _, key := range keys {
+			if routingKeyMatches(s.exchange.Kind, key, routingKey) {
+				queues = append(queues, queueName)
+				break
+			}
+		}
+	}
+	return queues
+}
+
+// dispatch hands messages to a single consumer, up to its prefetch count at a time
+func (s *MemoryMQService) dispatch(ctx context.Context, queueName string, consumer *memoryConsumer, msgs chan<- amqp.Delivery) {
+	defer close(msgs)
+
+	for {
+		s.mu.Lock()
+		for !s.closed && ctx.Err() == nil && (len(s.queues[queueName]) == 0 || consumer.inFlight >= consumer.prefetch) {
+			s.cond.Wait()
+		}
+		if s.closed || ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+
+		delivery := s.queues[queueName][0]
+		s.queues[queueName] = s.queues[queueName][1:]
+
+		s.nextTag++
+		delivery.DeliveryTag = s.nextTag
+		delivery.Acknowledger = s
+		s.unacked[delivery.DeliveryTag] = &memoryDelivery{queue: queueName, delivery: delivery, consumer: consumer}
+		consumer.inFlight++
+		s.mu.Unlock()
+
+		select {
+		case msgs <- delivery:
+		case <-ctx.Done():
+			// The consumer stopped before taking the message
+			s.Nack(delivery.DeliveryTag, false, true)
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Ack implements amqp.Acknowledger
+func (s *MemoryMQService) Ack(tag uint64, multiple bool) error {
+	return s.settle(tag, multiple, false)
+}
+
+// Nack implements amqp.Acknowledger
+func (s *MemoryMQService) Nack(tag uint64, multiple bool, requeue bool) error {
+	return s.settle(tag, multiple, requeue)
+}
+
+// Reject implements amqp.Acknowledger
+func (s *MemoryMQService) Reject(tag uint64, requeue bool) error {
+	return s.settle(tag, false, requeue)
+}
+
+// settle removes acknowledged messages and puts them back on their queue when requeue is set
+func (s *MemoryMQService) settle(tag uint64, multiple bool, requeue bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t, p := range s.unacked {
+			if t <= tag && p.consumer == pending.consumer {
+				tags = append(tags, t)
+			}
+		}
+	}
+
+	for _, t := range tags {
+		p := s.unacked[t]
+		delete(s.unacked, t)
+		p.consumer.inFlight--
+		if requeue {
+			s.requeue(p)
+		}
+	}
+	s.cond.Broadcast()
+
+	return nil
+}
+
+// requeue puts a message back at the head of its queue, must be called with the lock held
+func (s *MemoryMQService) requeue(pending *memoryDelivery) {
+	delivery := pending.delivery
+	delivery.Acknowledger = nil
+	delivery.DeliveryTag = 0
+	delivery.Redelivered = true
+	s.queues[pending.queue] = append([]amqp.Delivery{delivery}, s.queues[pending.queue]...)
+}
+
+// SetRetryPolicy changes the retry policy, so tests do not wait for the default delay
+func (s *MemoryMQService) SetRetryPolicy(policy RetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retry = policy
+}
+
+// Retry acks a failed delivery and puts it back on queueName after the retry delay,
+// or dead-letters it once the retries are used up
+func (s *MemoryMQService) Retry(ctx context.Context, queueName string, d amqp.Delivery, reason error) error {
+	if err := ctx.Err(); err != nil {
+		d.Nack(false, true)
+		return fmt.Errorf("failed to retry a message: %w", err)
+	}
+
+	s.mu.Lock()
+	policy := s.retry
+	s.mu.Unlock()
+
+	retries := RetryCount(d)
+	if retries >= policy.MaxRetries {
+		return s.DeadLetter(ctx, queueName, d, fmt.Errorf("retries exhausted after %d attempts: %v", retries+1, reason))
+	}
+
+	retried := failedDelivery(queueName, d, retries+1, reason)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		d.Nack(false, true)
+		return fmt.Errorf("failed to retry a message: broker is closed")
+	}
+	s.delayed++
+	s.mu.Unlock()
+
+	time.AfterFunc(policy.Delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.delayed--
+		if !s.closed {
+			s.queues[queueName] = append(s.queues[queueName], retried)
+		}
+		s.cond.Broadcast()
+	})
+
+	return d.Ack(false)
+}
+
+// DeadLetter acks a delivery and parks it in the dead letter queue of queueName
+func (s *MemoryMQService) DeadLetter(ctx context.Context, queueName string, d amqp.Delivery, reason error) error {
+	if err := ctx.Err(); err != nil {
+		d.Nack(false, true)
+		return fmt.Errorf("failed to dead-letter a message: %w", err)
+	}
+
+	deadLettered := failedDelivery(queueName, d, RetryCount(d), reason)
+	dlq := DeadLetterQueueName(queueName)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		d.Nack(false, true)
+		return fmt.Errorf("failed to dead-letter a message: broker is closed")
+	}
+	deadLettered.RoutingKey = dlq
+	s.queues[dlq] = append(s.queues[dlq], deadLettered)
+	s.mu.Unlock()
+
+	return d.Ack(false)
+}
+
+// failedDelivery copies a delivery so it can be queued again
+func failedDelivery(queueName string, d amqp.Delivery, retries int, reason error) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:       failedHeaders(queueName, d, retries, reason),
+		ContentType:   d.ContentType,
+		ReplyTo:       d.ReplyTo,
+		CorrelationId: d.CorrelationId,
+		Timestamp:     d.Timestamp,
+		RoutingKey:    queueName,
+		Body:          append([]byte(nil), d.Body...),
+	}
+}
+
+// Fetch hands up to limit messages of the named queue to handlerFunc, or all of
+// them when limit is 0. Messages that are not acknowledged by handlerFunc are put
+// back on the queue in their original order.
+func (s *MemoryMQService) Fetch(ctx context.Context, queueName string, limit int, handlerFunc func([]amqp.Delivery) error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to get a message: %w", err)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to get a message: broker is closed")
+	}
+
+	n := len(s.queues[queueName])
+	if limit > 0 && limit < n {
+		n = limit
+	}
+
+	consumer := &memoryConsumer{}
+	deliveries := make([]amqp.Delivery, 0, n)
+	for _, delivery := range s.queues[queueName][:n] {
+		s.nextTag++
+		delivery.DeliveryTag = s.nextTag
+		delivery.Acknowledger = s
+		s.unacked[delivery.DeliveryTag] = &memoryDelivery{queue: queueName, delivery: delivery, consumer: consumer}
+		consumer.inFlight++
+		deliveries = append(deliveries, delivery)
+	}
+	s.queues[queueName] = s.queues[queueName][n:]
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Requeue from the last message so that the first one ends up at the head
+		for i := len(deliveries) - 1; i >= 0; i-- {
+			tag := deliveries[i].DeliveryTag
+			if pending, ok := s.unacked[tag]; ok {
+				delete(s.unacked, tag)
+				if !s.closed {
+					s.requeue(pending)
+				}
+			}
+		}
+		s.cond.Broadcast()
+	}()
+
+	return handlerFunc(deliveries)
+}
+
+// QueueLength returns the number of messages waiting on the named queue
+func (s *MemoryMQService) QueueLength(queueName string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queues[queueName])
+}
+
+// WaitIdle blocks until every queue except the dead letter queues is empty, every
+// delivered message has been settled and no retry is pending, or the timeout expires. It reports whether the broker became idle.
+func (s *MemoryMQService) WaitIdle(timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.idle() {
+		if s.closed || !time.Now().Before(deadline) {
+			return false
+		}
+		s.cond.Wait()
+	}
+	return true
+}
+
+// idle must be called with the lock held
+func (s *MemoryMQService) idle() bool {
+	if len(s.unacked) > 0 || s.delayed > 0 {
+		return false
+	}
+	for queueName, messages := range s.queues {
+		if len(messages) > 0 && !isDeadLetterQueue(queueName) {
+			return false
+		}
+	}
+	return true
+}
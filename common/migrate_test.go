@@ -0,0 +1,93 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("select 1;")}
+
+	tests := []struct {
+		name    string
+		files   []string
+		want    []int64
+		wantErr bool
+	}{
+		{
+			// Versions sort as numbers, not as file names
+			name:  "ordering",
+			files: []string{"10_c.up.sql", "10_c.down.sql", "2_b.up.sql", "2_b.down.sql", "0001_a.up.sql", "0001_a.down.sql"},
+			want:  []int64{1, 2, 10},
+		},
+		{name: "missing down", files: []string{"0001_a.up.sql"}, wantErr: true},
+		{name: "invalid name", files: []string{"0001_a.up.sql", "0001_a.down.sql", "initial.sql"}, wantErr: true},
+		{name: "duplicate version", files: []string{"0001_a.up.sql", "0001_a.down.sql", "0001_b.up.sql", "0001_b.down.sql"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		fsys := fstest.MapFS{}
+		for _, name := range tt.files {
+			fsys["migrations/"+name] = file
+		}
+
+		migrations, err := loadMigrations(fsys, "migrations")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadMigrations() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+
+		var versions []int64
+		for _, migration := range migrations {
+			versions = append(versions, migration.Version)
+		}
+		if !reflect.DeepEqual(versions, tt.want) {
+			t.Errorf("%s: loadMigrations() versions = %v, want %v", tt.name, versions, tt.want)
+		}
+	}
+}
+
+func TestMigratorPendingAndApplied(t *testing.T) {
+	migrator := &Migrator{migrations: []*Migration{{Version: 1}, {Version: 2}, {Version: 3}}}
+	applied := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		versions    []int64
+		steps       int
+		wantPending []int64
+		wantApplied []int64
+	}{
+		{name: "empty", steps: 1, wantPending: []int64{1, 2, 3}},
+		{name: "partly applied", versions: []int64{1, 2}, steps: 1, wantPending: []int64{3}, wantApplied: []int64{2}},
+		{name: "up to date", versions: []int64{1, 2, 3}, steps: 2, wantApplied: []int64{3, 2}},
+		// A gap left by an out of order deploy is applied, and skipped when reverting
+		{name: "gap", versions: []int64{1, 3}, steps: 5, wantPending: []int64{2}, wantApplied: []int64{3, 1}},
+		// Versions unknown to this build are left alone
+		{name: "unknown version", versions: []int64{1, 4}, steps: 2, wantPending: []int64{2, 3}, wantApplied: []int64{1}},
+	}
+
+	versionsOf := func(migrations []*Migration) []int64 {
+		var versions []int64
+		for _, migration := range migrations {
+			versions = append(versions, migration.Version)
+		}
+		return versions
+	}
+
+	for _, tt := range tests {
+		versions := make(map[int64]time.Time)
+		for _, version := range tt.versions {
+			versions[version] = applied
+		}
+
+		if got := versionsOf(migrator.pending(versions)); !reflect.DeepEqual(got, tt.wantPending) {
+			t.Errorf("%s: pending() = %v, want %v", tt.name, got, tt.wantPending)
+		}
+		if got := versionsOf(migrator.applied(versions, tt.steps)); !reflect.DeepEqual(got, tt.wantApplied) {
+			t.Errorf("%s: applied(%d) = %v, want %v", tt.name, tt.steps, got, tt.wantApplied)
+		}
+	}
+}
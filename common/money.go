@@ -0,0 +1,284 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of amounts sent without one, by clients
+// and messages that predate currencies
+const DefaultCurrency = "USD"
+
+var (
+	// ErrUnknownCurrency is returned for currency codes without a known minor unit
+	ErrUnknownCurrency = errors.New("unknown currency")
+
+	// ErrCurrencyMismatch is returned when amounts of different currencies are combined
+	ErrCurrencyMismatch = errors.New("currencies do not match")
+)
+
+// currencyDigits is the number of decimal places of the minor unit of each
+// supported ISO 4217 currency. Prices are stored with 2 decimal places, so
+// currencies with smaller minor units are not supported.
+var currencyDigits = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"USD": 2,
+}
+
+// Money is an exact amount in the minor unit of its currency, such as cents.
+//
+// Amounts are never rounded implicitly: parsing rejects amounts with more
+// decimal places than the currency has, and arithmetic is done on whole
+// minor units and fails instead of overflowing. Convert is the only operation
+// that rounds, to the nearest minor unit with halves away from zero.
+type Money struct {
+	// Amount is the number of minor units
+	Amount int64
+
+	// Currency is the ISO 4217 code of the currency
+	Currency string
+}
+
+// ValidCurrency reports whether currency is supported
+func ValidCurrency(currency string) bool {
+	_, ok := currencyDigits[currency]
+	return ok
+}
+
+// ParseMoney parses a decimal amount such as 12.5 or -0.99 in the given currency
+func ParseMoney(amount, currency string) (Money, error) {
+	digits, ok := currencyDigits[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+
+	s := amount
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("invalid amount %q", amount)
+	}
+
+	// Trailing zeros past the minor unit do not change the amount
+	if len(frac) > digits {
+		if strings.Trim(frac[digits:], "0") != "" {
+			return Money{}, fmt.Errorf("amount %s has more than %d decimal places for %s", amount, digits, currency)
+		}
+		frac = frac[:digits]
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("amount %s is out of range", amount)
+	}
+	if negative {
+		n = -n
+	}
+
+	return Money{Amount: n, Currency: currency}, nil
+}
+
+// MustParseMoney is like ParseMoney but panics on invalid amounts, for constants
+func MustParseMoney(amount, currency string) Money {
+	m, err := ParseMoney(amount, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Scale is the number of minor units in one unit of the currency
+func (m Money) Scale() int64 {
+	scale := int64(1)
+	for i := 0; i < m.digits(); i++ {
+		scale *= 10
+	}
+	return scale
+}
+
+func (m Money) digits() int {
+	if digits, ok := currencyDigits[m.Currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// Decimal formats the amount with the decimal places of its currency, such as 12.50
+func (m Money) Decimal() string {
+	sign := ""
+	amount := uint64(m.Amount)
+	if m.Amount < 0 {
+		sign = "-"
+		amount = uint64(-(m.Amount + 1)) + 1
+	}
+
+	s := strconv.FormatUint(amount, 10)
+	digits := m.digits()
+	if digits == 0 {
+		return sign + s
+	}
+
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// Add returns the sum of two amounts of the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	if (other.Amount > 0 && m.Amount > math.MaxInt64-other.Amount) ||
+		(other.Amount < 0 && m.Amount < math.MinInt64-other.Amount) {
+		return Money{}, fmt.Errorf("sum of %s and %s is out of range", m, other)
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// Mul returns the amount multiplied by a quantity
+func (m Money) Mul(quantity int64) (Money, error) {
+	if quantity != 0 && (m.Amount*quantity/quantity != m.Amount ||
+		(m.Amount == -1 && quantity == math.MinInt64) || (quantity == -1 && m.Amount == math.MinInt64)) {
+		return Money{}, fmt.Errorf("%s times %d is out of range", m, quantity)
+	}
+	return Money{Amount: m.Amount * quantity, Currency: m.Currency}, nil
+}
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or +1
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// ParseRate parses a decimal exchange rate such as 0.9215 exactly
+func ParseRate(rate string) (*big.Rat, error) {
+	whole, frac, _ := strings.Cut(rate, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return nil, fmt.Errorf("invalid exchange rate %q", rate)
+	}
+
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok {
+		return nil, fmt.Errorf("invalid exchange rate %q", rate)
+	}
+	if r.Sign() <= 0 {
+		return nil, fmt.Errorf("exchange rate must be greater than 0")
+	}
+	return r, nil
+}
+
+// Convert converts the amount to currency with rate, the price of one unit of the
+// amount's currency in currency. The result is rounded to the nearest minor unit
+// of currency, halves are rounded away from zero.
+func (m Money) Convert(currency string, rate *big.Rat) (Money, error) {
+	if !ValidCurrency(currency) {
+		return Money{}, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+	target := Money{Currency: currency}
+
+	// Minor units of m times the rate, rescaled to the minor unit of currency
+	v := new(big.Rat).SetInt64(m.Amount)
+	v.Mul(v, rate)
+	v.Mul(v, new(big.Rat).SetFrac64(target.Scale(), m.Scale()))
+
+	// Round half away from zero: truncate |v| + 1/2
+	half := big.NewRat(1, 2)
+	abs := new(big.Rat).Abs(v)
+	abs.Add(abs, half)
+	rounded := new(big.Int).Quo(abs.Num(), abs.Denom())
+	if v.Sign() < 0 {
+		rounded.Neg(rounded)
+	}
+
+	if !rounded.IsInt64() {
+		return Money{}, fmt.Errorf("%s converted to %s is out of range", m, currency)
+	}
+	target.Amount = rounded.Int64()
+	return target, nil
+}
+
+// moneyJSON is the JSON form of Money. The amount is a decimal string,
+// so clients do not read it into a float.
+type moneyJSON struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Currency})
+}
+
+// UnmarshalJSON reads {"amount": "12.50", "currency": "EUR"}. The amount can also
+// be a JSON number, and a bare number or numeric string is an amount in DefaultCurrency.
+// Numbers are parsed from their text, so they are exact.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+
+	var v moneyJSON
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("invalid money %s: %v", data, err)
+		}
+	} else if err := json.Unmarshal(data, &v.Amount); err != nil {
+		return fmt.Errorf("invalid money %s: %v", data, err)
+	}
+
+	if v.Currency == "" {
+		v.Currency = DefaultCurrency
+	}
+
+	parsed, err := ParseMoney(v.Amount.String(), v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
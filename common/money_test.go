@@ -0,0 +1,225 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{amount: "12.5", currency: "USD", want: Money{Amount: 1250, Currency: "USD"}},
+		{amount: "12.50", currency: "EUR", want: Money{Amount: 1250, Currency: "EUR"}},
+		{amount: "-0.99", currency: "USD", want: Money{Amount: -99, Currency: "USD"}},
+		{amount: "7", currency: "USD", want: Money{Amount: 700, Currency: "USD"}},
+		{amount: "1.2000", currency: "USD", want: Money{Amount: 120, Currency: "USD"}},
+		{amount: "500", currency: "JPY", want: Money{Amount: 500, Currency: "JPY"}},
+		{amount: "500.0", currency: "JPY", want: Money{Amount: 500, Currency: "JPY"}},
+		{amount: "0.001", currency: "USD", wantErr: true},
+		{amount: "500.5", currency: "JPY", wantErr: true},
+		{amount: ".5", currency: "USD", wantErr: true},
+		{amount: "1e3", currency: "USD", wantErr: true},
+		{amount: "+1", currency: "USD", wantErr: true},
+		{amount: "", currency: "USD", wantErr: true},
+		{amount: "99999999999999999999", currency: "USD", wantErr: true},
+		{amount: "1", currency: "XYZ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.amount, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMoney(%q, %s) = %v, want an error", tt.amount, tt.currency, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseMoney(%q, %s) failed: %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+
+	if _, err := ParseMoney("1", "XYZ"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("ParseMoney with an unknown currency = %v, want ErrUnknownCurrency", err)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{Money{Amount: 1250, Currency: "USD"}, "12.50 USD"},
+		{Money{Amount: 5, Currency: "EUR"}, "0.05 EUR"},
+		{Money{Amount: -5, Currency: "EUR"}, "-0.05 EUR"},
+		{Money{Amount: 0, Currency: "USD"}, "0.00 USD"},
+		{Money{Amount: 500, Currency: "JPY"}, "500 JPY"},
+		{Money{Amount: -9223372036854775808, Currency: "USD"}, "-92233720368547758.08 USD"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("%#v.String() = %s, want %s", tt.money, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	usd := MustParseMoney("10.25", "USD")
+
+	sum, err := usd.Add(MustParseMoney("0.75", "USD"))
+	if err != nil || sum != MustParseMoney("11", "USD") {
+		t.Errorf("Add = %v, %v, want 11.00 USD", sum, err)
+	}
+	if _, err := usd.Add(MustParseMoney("1", "EUR")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add of another currency = %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := (Money{Amount: 1 << 62, Currency: "USD"}).Add(Money{Amount: 1 << 62, Currency: "USD"}); err == nil {
+		t.Error("Add overflowing int64 succeeded")
+	}
+
+	product, err := usd.Mul(3)
+	if err != nil || product != MustParseMoney("30.75", "USD") {
+		t.Errorf("Mul = %v, %v, want 30.75 USD", product, err)
+	}
+	if _, err := (Money{Amount: 1 << 62, Currency: "USD"}).Mul(4); err == nil {
+		t.Error("Mul overflowing int64 succeeded")
+	}
+
+	if cmp, err := usd.Cmp(MustParseMoney("10.26", "USD")); err != nil || cmp != -1 {
+		t.Errorf("Cmp = %d, %v, want -1", cmp, err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    string
+		wantErr bool
+	}{
+		{rate: "0.9215", want: "1843/2000"},
+		{rate: "150", want: "150/1"},
+		{rate: "1.10", want: "11/10"},
+		{rate: "0", wantErr: true},
+		{rate: "-1.5", wantErr: true},
+		{rate: "1/3", wantErr: true},
+		{rate: "1e2", wantErr: true},
+		{rate: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.rate)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRate(%q) = %v, want an error", tt.rate, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRate(%q) failed: %v", tt.rate, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("ParseRate(%q) = %s, want %s", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyConvert(t *testing.T) {
+	tests := []struct {
+		from    Money
+		to      string
+		rate    string
+		want    Money
+		wantErr bool
+	}{
+		{from: MustParseMoney("10", "USD"), to: "EUR", rate: "0.9215", want: MustParseMoney("9.22", "EUR")},
+		// 0.05 * 0.9 = 0.045 is a half, rounded away from zero
+		{from: MustParseMoney("0.05", "USD"), to: "EUR", rate: "0.9", want: MustParseMoney("0.05", "EUR")},
+		{from: MustParseMoney("-0.05", "USD"), to: "EUR", rate: "0.9", want: MustParseMoney("-0.05", "EUR")},
+		{from: MustParseMoney("0.01", "USD"), to: "EUR", rate: "0.4", want: MustParseMoney("0", "EUR")},
+		{from: MustParseMoney("12.34", "USD"), to: "JPY", rate: "150.5", want: MustParseMoney("1857", "JPY")},
+		{from: MustParseMoney("1857", "JPY"), to: "USD", rate: "0.0066", want: MustParseMoney("12.26", "USD")},
+		{from: MustParseMoney("1", "USD"), to: "XYZ", rate: "1", wantErr: true},
+		{from: Money{Amount: 1 << 62, Currency: "USD"}, to: "EUR", rate: "4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.from.Convert(tt.to, mustParseRate(t, tt.rate))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v.Convert(%s, %s) = %v, want an error", tt.from, tt.to, tt.rate, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v.Convert(%s, %s) failed: %v", tt.from, tt.to, tt.rate, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v.Convert(%s, %s) = %v, want %v", tt.from, tt.to, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func mustParseRate(t *testing.T, rate string) *big.Rat {
+	t.Helper()
+
+	r, err := ParseRate(rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    Money
+		wantErr bool
+	}{
+		{data: `{"amount": "12.50", "currency": "EUR"}`, want: MustParseMoney("12.5", "EUR")},
+		{data: `{"amount": 12.5, "currency": "EUR"}`, want: MustParseMoney("12.5", "EUR")},
+		{data: `{"amount": "3"}`, want: MustParseMoney("3", DefaultCurrency)},
+		{data: `19.99`, want: MustParseMoney("19.99", DefaultCurrency)},
+		{data: `"19.99"`, want: MustParseMoney("19.99", DefaultCurrency)},
+		{data: `{"amount": "0.001", "currency": "USD"}`, wantErr: true},
+		{data: `{"amount": "1", "currency": "XYZ"}`, wantErr: true},
+		{data: `"abc"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var got Money
+		err := json.Unmarshal([]byte(tt.data), &got)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("unmarshal %s = %v, want an error", tt.data, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unmarshal %s failed: %v", tt.data, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("unmarshal %s = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+
+	data, err := json.Marshal(MustParseMoney("12.5", "EUR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"amount":"12.50","currency":"EUR"}`; string(data) != want {
+		t.Errorf("marshal = %s, want %s", data, want)
+	}
+}
@@ -1,16 +1,45 @@
 package common
 
+// Types of payment requests. Payments are authorized when the order is created,
+// which places a hold on the amount, and the hold is captured when the order is
+// fulfilled or voided when it is canceled. Captured payments are refunded when
+// a paid order is canceled.
 const (
-	PaymentFailed      = "failed"
+	PaymentAuthorize = "authorize"
+	PaymentCapture   = "capture"
+	PaymentVoid      = "void"
+	PaymentRefund    = "refund"
+)
+
+// Statuses of payment responses
+const (
+	PaymentAuthorized = "authorized"
+	PaymentCaptured   = "captured"
+	PaymentVoided     = "voided"
+	PaymentRefunded   = "refunded"
+	PaymentFailed     = "failed"
+
+	// PaymentSuccessfull is the status of payments taken in a single step,
+	// sent by payment services that predate authorizations
 	PaymentSuccessfull = "successfull"
 )
 
 type PaymentRequest struct {
-	OrderID    string  `json:"orderId"`
-	TotalPrice float64 `json:"totalPrice"`
+	// Type is PaymentAuthorize, PaymentCapture, PaymentVoid or PaymentRefund.
+	// Requests without a type are authorizations.
+	Type       string `json:"type,omitempty"`
+	OrderID    string `json:"orderId"`
+	CustomerID string `json:"customerId,omitempty"`
+	TotalPrice Money  `json:"totalPrice"`
 }
 
 type PaymentResponse struct {
+	// Type is the type of the request answered, responses without a type
+	// answer authorizations
+	Type          string `json:"type,omitempty"`
 	OrderID       string `json:"orderId"`
 	PaymentStatus string `json:"paymentStatus"`
+
+	// Reason explains why a payment failed
+	Reason string `json:"reason,omitempty"`
 }
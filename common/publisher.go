@@ -0,0 +1,169 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrPublishNacked is returned when the broker could not take responsibility for a message
+	ErrPublishNacked = errors.New("message was nacked by the broker")
+
+	// ErrUnroutable is returned when a message did not reach any queue
+	ErrUnroutable = errors.New("message could not be routed to a queue")
+)
+
+const (
+	// publisherPoolSize is the number of idle publishing channels kept open
+	publisherPoolSize = 4
+
+	// publishConfirmTimeout is how long Publish waits for the broker to confirm a message
+	publishConfirmTimeout = 5 * time.Second
+)
+
+// publisher is a long lived channel in confirm mode. It is used by one
+// publish at a time, so confirms and returns belong to the last message.
+type publisher struct {
+	ch       *amqp.Channel
+	exchange Exchange
+	closed   chan *amqp.Error
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+
+	// declared lists the queues whose topology was declared on this channel
+	declared map[string]bool
+}
+
+func newPublisher(ch *amqp.Channel, exchange Exchange) (*publisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to put the channel in confirm mode: %v", err)
+	}
+
+	return &publisher{
+		ch:       ch,
+		exchange: exchange,
+		closed:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+		declared: make(map[string]bool),
+	}, nil
+}
+
+// usable reports whether the channel is still open
+func (p *publisher) usable() bool {
+	select {
+	case <-p.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// publish sends a persistent, mandatory message and waits for the broker to confirm it
+// until the confirm timeout or until ctx is done.
+// queueName is the queue whose topology the message is routed through.
+func (p *publisher) publish(ctx context.Context, queueName, exchange, routingKey string, message amqp.Publishing) error {
+	if !p.declared[queueName] {
+		if _, err := declareQueue(p.ch, p.exchange, queueName); err != nil {
+			return err
+		}
+		p.declared[queueName] = true
+	}
+
+	message.DeliveryMode = amqp.Persistent
+	err := p.ch.Publish(
+		exchange,   // Exchange
+		routingKey, // Routing key
+		true,       // Mandatory
+		false,      // Immediate
+		message,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish a message: %v", err)
+	}
+
+	timeout := time.NewTimer(publishConfirmTimeout)
+	defer timeout.Stop()
+
+	select {
+	case confirm, ok := <-p.confirms:
+		if !ok {
+			return fmt.Errorf("failed to publish a message: channel closed before the broker confirmed it")
+		}
+
+		// Returns are delivered before the confirm of the same message
+		select {
+		case ret := <-p.returns:
+			return fmt.Errorf("%w: %s %s", ErrUnroutable, ret.ReplyText, routingKey)
+		default:
+		}
+
+		if !confirm.Ack {
+			return ErrPublishNacked
+		}
+		return nil
+
+	case <-timeout.C:
+		return fmt.Errorf("failed to publish a message: no confirm from the broker after %v", publishConfirmTimeout)
+
+	case <-ctx.Done():
+		return fmt.Errorf("failed to publish a message: %w", ctx.Err())
+	}
+}
+
+// getPublisher takes an idle publisher from the pool or opens a new one
+func (s *RabbitMQService) getPublisher(ctx context.Context) (*publisher, error) {
+	for {
+		s.mu.Lock()
+		n := len(s.publishers)
+		if n == 0 {
+			s.mu.Unlock()
+			break
+		}
+		p := s.publishers[n-1]
+		s.publishers = s.publishers[:n-1]
+		s.mu.Unlock()
+
+		if p.usable() {
+			return p, nil
+		}
+	}
+
+	ch, err := s.channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newPublisher(ch, s.exchange)
+}
+
+// putPublisher returns a publisher to the pool. Publishers that did not get a confirm
+// are closed, since a confirm that arrives late would be taken for the next message.
+func (s *RabbitMQService) putPublisher(p *publisher, reuse bool) {
+	if reuse && p.usable() {
+		s.mu.Lock()
+		if !s.closed && len(s.publishers) < publisherPoolSize {
+			s.publishers = append(s.publishers, p)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+	p.ch.Close()
+}
+
+// publish publishes a message with confirms on a pooled channel
+func (s *RabbitMQService) publish(ctx context.Context, queueName, exchange, routingKey string, message amqp.Publishing) error {
+	p, err := s.getPublisher(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = p.publish(ctx, queueName, exchange, routingKey, message)
+	s.putPublisher(p, err == nil || errors.Is(err, ErrUnroutable) || errors.Is(err, ErrPublishNacked))
+	return err
+}
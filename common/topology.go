@@ -0,0 +1,150 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Exchange types supported for the configured exchange
+const (
+	ExchangeDirect = "direct"
+	ExchangeTopic  = "topic"
+)
+
+// Exchange is the exchange messages are published to and queues are bound to.
+// An empty name is the default exchange, which delivers a message to the queue
+// named by its routing key.
+type Exchange struct {
+	Name string
+	Kind string
+}
+
+// NewExchange validates the exchange settings, the kind defaults to direct
+func NewExchange(name, kind string) (Exchange, error) {
+	switch kind {
+	case "":
+		kind = ExchangeDirect
+	case ExchangeDirect, ExchangeTopic:
+	default:
+		return Exchange{}, fmt.Errorf("unsupported exchange type %s, expected %s or %s", kind, ExchangeDirect, ExchangeTopic)
+	}
+
+	return Exchange{Name: name, Kind: kind}, nil
+}
+
+// declareQueue declares a queue bound to the exchange with its own name as routing
+// key, together with its retry and dead letter queues
+func declareQueue(ch *amqp.Channel, exchange Exchange, queueName string) (amqp.Queue, error) {
+	q, err := ch.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		return q, fmt.Errorf("failed to declare a queue: %v", err)
+	}
+
+	if exchange.Name != "" {
+		err = ch.ExchangeDeclare(
+			exchange.Name, // name
+			exchange.Kind, // type
+			true,          // durable
+			false,         // auto-deleted
+			false,         // internal
+			false,         // no-wait
+			nil,           // arguments
+		)
+		if err != nil {
+			return q, fmt.Errorf("failed to declare the exchange: %v", err)
+		}
+
+		err = ch.QueueBind(q.Name, queueName, exchange.Name, false, nil)
+		if err != nil {
+			return q, fmt.Errorf("failed to bind the queue: %v", err)
+		}
+	}
+
+	// Expired messages of the retry queue go back to the queue through the default
+	// exchange, so they are not delivered again to other queues bound to the exchange
+	_, err = ch.QueueDeclare(
+		RetryQueueName(queueName), // name
+		true,                      // durable
+		false,                     // delete when unused
+		false,                     // exclusive
+		false,                     // no-wait
+		amqp.Table{ // arguments
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		},
+	)
+	if err != nil {
+		return q, fmt.Errorf("failed to declare the retry queue: %v", err)
+	}
+
+	err = ch.ExchangeDeclare(
+		DeadLetterExchange, // name
+		ExchangeDirect,     // type
+		true,               // durable
+		false,              // auto-deleted
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return q, fmt.Errorf("failed to declare the dead letter exchange: %v", err)
+	}
+
+	dlq, err := ch.QueueDeclare(
+		DeadLetterQueueName(queueName), // name
+		true,                           // durable
+		false,                          // delete when unused
+		false,                          // exclusive
+		false,                          // no-wait
+		nil,                            // arguments
+	)
+	if err != nil {
+		return q, fmt.Errorf("failed to declare the dead letter queue: %v", err)
+	}
+
+	err = ch.QueueBind(dlq.Name, queueName, DeadLetterExchange, false, nil)
+	if err != nil {
+		return q, fmt.Errorf("failed to bind the dead letter queue: %v", err)
+	}
+
+	return q, nil
+}
+
+// routingKeyMatches reports whether a binding key of the exchange selects the routing key.
+// Topic binding keys are dot separated words where * matches one word and # matches
+// zero or more words.
+func routingKeyMatches(kind, bindingKey, routingKey string) bool {
+	if kind != ExchangeTopic {
+		return bindingKey == routingKey
+	}
+	return topicMatches(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+}
+
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+	"github.com/streadway/amqp"
+)
+
+// dlqSelector picks the dead-lettered messages a command applies to
+type dlqSelector struct {
+	all           bool
+	correlationId string
+	orderId       string
+}
+
+func (s dlqSelector) empty() bool {
+	return !s.all && s.correlationId == "" && s.orderId == ""
+}
+
+func (s dlqSelector) matches(d amqp.Delivery) bool {
+	if s.correlationId != "" && d.CorrelationId != s.correlationId {
+		return false
+	}
+	if s.orderId != "" && messageOrderID(d) != s.orderId {
+		return false
+	}
+	return true
+}
+
+// selectDeadLetters returns up to limit of the deliveries matched by sel, or all of them
+// when limit is 0. Messages are filtered before the limit, so matching messages behind
+// limit others in the queue are still found.
+func (s dlqSelector) selectDeadLetters(deliveries []amqp.Delivery, limit int) []amqp.Delivery {
+	var selected []amqp.Delivery
+	for _, d := range deliveries {
+		if limit > 0 && len(selected) == limit {
+			break
+		}
+		if s.matches(d) {
+			selected = append(selected, d)
+		}
+	}
+	return selected
+}
+
+func runDLQ(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing dlq command, expected list, show or replay")
+	}
+
+	var (
+		sel   dlqSelector
+		queue string
+		limit int
+	)
+	fs := flag.NewFlagSet("dlq "+args[0], flag.ContinueOnError)
+	fs.StringVar(&queue, "queue", "", "queue whose dead letter queue is used, default all payment queues")
+	fs.IntVar(&limit, "limit", 100, "maximum number of messages per queue, 0 for all")
+	fs.StringVar(&sel.correlationId, "correlation-id", "", "only messages with this correlation id")
+	fs.StringVar(&sel.orderId, "order-id", "", "only messages of this order")
+	if args[0] == "replay" {
+		fs.BoolVar(&sel.all, "all", false, "replay all messages")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+
+	queues := paymentQueues()
+	if queue != "" {
+		queues = []string{queue}
+	}
+
+	// Replayed messages are published through the default exchange, so they reach
+	// their original queue only and not the other queues bound to the routing key
+	mqSvc, err := common.NewRabbitMQService(os.Getenv(amqpUrlStr), common.Exchange{})
+	if err != nil {
+		return err
+	}
+	defer mqSvc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch args[0] {
+	case "list":
+		return listDeadLetters(ctx, mqSvc, queues, limit, sel, os.Stdout)
+	case "show":
+		return showDeadLetters(ctx, mqSvc, queues, limit, sel, os.Stdout)
+	case "replay":
+		if sel.empty() {
+			return fmt.Errorf("select the messages to replay with -all, -correlation-id or -order-id")
+		}
+		return replayDeadLetters(ctx, mqSvc, queues, limit, sel, os.Stdout)
+	default:
+		return fmt.Errorf("unknown dlq command %s, expected list, show or replay", args[0])
+	}
+}
+
+// listDeadLetters prints a summary line per selected dead-lettered message, up to limit
+// per queue. The messages stay in the queue.
+func listDeadLetters(ctx context.Context, mqSvc common.MqSvc, queues []string, limit int, sel dlqSelector, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tCORRELATION ID\tORDER ID\tATTEMPTS\tFAILED AT\tREASON")
+
+	for _, queue := range queues {
+		err := mqSvc.Fetch(ctx, common.DeadLetterQueueName(queue), 0, func(deliveries []amqp.Delivery) error {
+			for _, d := range sel.selectDeadLetters(deliveries, limit) {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", queue, d.CorrelationId, messageOrderID(d),
+					common.RetryCount(d)+1, failedAt(d), headerString(d, common.FailureReasonHeader))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// showDeadLetters prints the headers and body of selected dead-lettered messages, up to
+// limit per queue. The messages stay in the queue.
+func showDeadLetters(ctx context.Context, mqSvc common.MqSvc, queues []string, limit int, sel dlqSelector, out io.Writer) error {
+	for _, queue := range queues {
+		err := mqSvc.Fetch(ctx, common.DeadLetterQueueName(queue), 0, func(deliveries []amqp.Delivery) error {
+			for _, d := range sel.selectDeadLetters(deliveries, limit) {
+				printDeadLetter(out, queue, d)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayDeadLetters publishes up to limit of the selected messages of every queue, or
+// all of them when limit is 0, to their original queue and removes them from the dead
+// letter queue. Replayed messages start with no retries.
+func replayDeadLetters(ctx context.Context, mqSvc common.MqSvc, queues []string, limit int, sel dlqSelector, out io.Writer) error {
+	for _, queue := range queues {
+		replayed := 0
+		err := mqSvc.Fetch(ctx, common.DeadLetterQueueName(queue), 0, func(deliveries []amqp.Delivery) error {
+			for _, d := range sel.selectDeadLetters(deliveries, limit) {
+				target := headerString(d, common.OriginalQueueHeader)
+				if target == "" {
+					target = queue
+				}
+
+				if err := mqSvc.Publish(ctx, target, d.Body, d.ReplyTo, d.CorrelationId); err != nil {
+					return fmt.Errorf("failed to replay message %s: %v", d.CorrelationId, err)
+				}
+				if err := d.Ack(false); err != nil {
+					return fmt.Errorf("failed to remove replayed message %s: %v", d.CorrelationId, err)
+				}
+				replayed++
+			}
+			return nil
+		})
+
+		fmt.Fprintf(out, "Replayed %d messages to %s\n", replayed, queue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printDeadLetter(out io.Writer, queue string, d amqp.Delivery) {
+	fmt.Fprintf(out, "Queue:          %s\n", queue)
+	fmt.Fprintf(out, "Correlation ID: %s\n", d.CorrelationId)
+	fmt.Fprintf(out, "Reply To:       %s\n", d.ReplyTo)
+
+	keys := make([]string, 0, len(d.Headers))
+	for k := range d.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(out, "Headers:")
+	for _, k := range keys {
+		fmt.Fprintf(out, "    %s: %v\n", k, d.Headers[k])
+	}
+
+	body := d.Body
+	var indented bytes.Buffer
+	if json.Indent(&indented, d.Body, "    ", "  ") == nil {
+		body = indented.Bytes()
+	}
+	fmt.Fprintf(out, "Body:\n    %s\n\n", body)
+}
+
+// messageOrderID reads the order id of a payment request or response
+func messageOrderID(d amqp.Delivery) string {
+	var message struct {
+		OrderID string `json:"orderId"`
+	}
+	if err := json.Unmarshal(d.Body, &message); err != nil || message.OrderID == "" {
+		return "-"
+	}
+	return message.OrderID
+}
+
+func failedAt(d amqp.Delivery) string {
+	t, ok := d.Headers[common.FailedAtHeader].(time.Time)
+	if !ok {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func headerString(d amqp.Delivery, key string) string {
+	v, _ := d.Headers[key].(string)
+	return v
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// All constants
+const (
+	amqpUrlStr           = "AMQP_SERVER_URL"
+	sendRoutingKeyStr    = "SEND_ROUTING_KEY"
+	receiveRoutingKeyStr = "RECEIVE_ROUTING_KEY"
+)
+
+// Queues used when the routing keys are not set in the environment
+const (
+	defaultOrdersQueue         = "processingorders"
+	defaultPaymentsStatusQueue = "processedorders"
+)
+
+const usage = `omsctl is the admin tool of the order management service.
+
+Usage:
+    omsctl dlq list    [-queue name] [-limit n]
+    omsctl dlq show    [-queue name] [-correlation-id id] [-order-id id]
+    omsctl dlq replay  [-queue name] (-all | -correlation-id id | -order-id id)
+
+Environment:
+    AMQP_SERVER_URL      RabbitMQ url
+    SEND_ROUTING_KEY     payment requests queue, default processingorders
+    RECEIVE_ROUTING_KEY  payment responses queue, default processedorders
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dlq":
+		err = runDLQ(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "omsctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// paymentQueues returns the queues of the payment requests and responses
+func paymentQueues() []string {
+	return []string{
+		envOrDefault(sendRoutingKeyStr, defaultOrdersQueue),
+		envOrDefault(receiveRoutingKeyStr, defaultPaymentsStatusQueue),
+	}
+}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
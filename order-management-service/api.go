@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/aayush993/go-order-management/common"
 	"github.com/gorilla/mux"
@@ -16,25 +21,66 @@ type APIServer struct {
 	config      *ServerConfig
 	rabbitmqSvc common.MqSvc
 	svc         Service
+	outbox      *OutboxRelay
 }
 
-func NewAPIServer(config *ServerConfig, rabbitmqSvc common.MqSvc, svc Service) *APIServer {
+func NewAPIServer(config *ServerConfig, rabbitmqSvc common.MqSvc, svc Service, outbox *OutboxRelay) *APIServer {
 	return &APIServer{
 		config:      config,
 		rabbitmqSvc: rabbitmqSvc,
 		svc:         svc,
+		outbox:      outbox,
 	}
 }
 
-func (s *APIServer) Run() {
+// shutdownTimeout bounds the time Run takes to stop once its context is canceled
+const shutdownTimeout = 30 * time.Second
+
+// Run serves the API and runs the background workers until ctx is canceled. It then
+// stops accepting requests, waits for in-flight requests and payment responses,
+// and publishes the pending outbox messages before returning.
+func (s *APIServer) Run(ctx context.Context) error {
 	router := mux.NewRouter()
 
 	// Worker process to listen to the processed payments
-	go s.ProcessPaymentsWorker()
-
-	// Register handlers for HTTP routes
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		s.ProcessPaymentsWorker(ctx)
+	}()
+
+	// Worker process to publish payment requests saved with orders
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		s.outbox.Run(ctx)
+	}()
+
+	// Register handlers for HTTP routes, every request gets the configured deadline
+	router.Use(TimeoutMiddleware(s.config.RequestTimeout))
 	router.HandleFunc("/orders", LoggingMiddleware(makeHTTPHandleFunc(s.HandleOrderCreate))).Methods("POST")
+	router.HandleFunc("/orders", LoggingMiddleware(makeHTTPHandleFunc(s.HandleOrderList))).Methods("GET")
 	router.HandleFunc("/orders/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleOrderRetrieve))).Methods("GET")
+	router.HandleFunc("/orders/{id}/cancel", LoggingMiddleware(makeHTTPHandleFunc(s.HandleOrderCancel))).Methods("POST")
+	router.HandleFunc("/orders/{id}/fulfill", LoggingMiddleware(makeHTTPHandleFunc(s.HandleOrderFulfill))).Methods("POST")
+
+	router.HandleFunc("/products", LoggingMiddleware(makeHTTPHandleFunc(s.HandleProductCreate))).Methods("POST")
+	router.HandleFunc("/products", LoggingMiddleware(makeHTTPHandleFunc(s.HandleProductList))).Methods("GET")
+	router.HandleFunc("/products/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleProductRetrieve))).Methods("GET")
+	router.HandleFunc("/products/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleProductUpdate))).Methods("PUT")
+	router.HandleFunc("/products/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleProductDelete))).Methods("DELETE")
+	router.HandleFunc("/products/{id}/inventory", LoggingMiddleware(makeHTTPHandleFunc(s.HandleInventoryRetrieve))).Methods("GET")
+	router.HandleFunc("/products/{id}/inventory", LoggingMiddleware(makeHTTPHandleFunc(s.HandleInventoryUpdate))).Methods("PUT")
+
+	router.HandleFunc("/customers", LoggingMiddleware(makeHTTPHandleFunc(s.HandleCustomerCreate))).Methods("POST")
+	router.HandleFunc("/customers", LoggingMiddleware(makeHTTPHandleFunc(s.HandleCustomerList))).Methods("GET")
+	router.HandleFunc("/customers/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleCustomerRetrieve))).Methods("GET")
+	router.HandleFunc("/customers/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleCustomerUpdate))).Methods("PUT")
+	router.HandleFunc("/customers/{id}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleCustomerDelete))).Methods("DELETE")
+	router.HandleFunc("/customers/{id}/orders", LoggingMiddleware(makeHTTPHandleFunc(s.HandleCustomerOrders))).Methods("GET")
+
+	router.HandleFunc("/exchange-rates", LoggingMiddleware(makeHTTPHandleFunc(s.HandleExchangeRateCreate))).Methods("POST")
+	router.HandleFunc("/exchange-rates/{base}/{quote}", LoggingMiddleware(makeHTTPHandleFunc(s.HandleExchangeRateRetrieve))).Methods("GET")
 
 	// Serve Swagger UI
 	// currently not working
@@ -43,24 +89,106 @@ func (s *APIServer) Run() {
 	// ))
 
 	listenAddr := ":" + s.config.Port
-	log.Println("[x] Server now listening on port: ", listenAddr)
-	http.ListenAndServe(listenAddr, router)
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: router,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("[x] Server now listening on port: ", listenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %v", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for in-flight requests
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to drain HTTP requests: %v", err)
+	}
+
+	// Wait for the payment responses being handled to be acked
+	select {
+	case <-consumerDone:
+	case <-shutdownCtx.Done():
+		log.Printf("Payment responses still being handled at the shutdown deadline")
+	}
+
+	// Publish the payment requests of the last orders
+	select {
+	case <-relayDone:
+		s.outbox.Flush(shutdownCtx)
+	case <-shutdownCtx.Done():
+	}
+
+	log.Printf("[x] Server stopped")
+	return nil
 }
 
 type CreateOrderRequest struct {
-	CustomerId string `json:"customerId"`
-	ProductId  string `json:"productId"`
-	Quantity   int64  `json:"quantity"`
+	CustomerId string             `json:"customerId"`
+	Items      []OrderItemRequest `json:"items"`
+
+	// Currency the order is priced in, default USD
+	Currency string `json:"currency,omitempty"`
+
+	// ProductId and Quantity are accepted for single product orders
+	// from clients that predate line items
+	ProductId string `json:"productId,omitempty"`
+	Quantity  int64  `json:"quantity,omitempty"`
+}
+
+// idempotencyKeyHeader lets clients retry POST /orders without creating duplicate orders
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// hash identifies the request independently of JSON formatting and of the
+// single product shorthand, so equivalent retries match the stored key. Orders
+// without a currency are priced in USD and hash like orders in USD.
+func (r *CreateOrderRequest) hash() (string, error) {
+	currency := r.Currency
+	if currency == "" {
+		currency = common.DefaultCurrency
+	}
+
+	canonical, err := json.Marshal(struct {
+		CustomerId string             `json:"customerId"`
+		Items      []OrderItemRequest `json:"items"`
+		Currency   string             `json:"currency"`
+	}{r.CustomerId, r.orderItems(), currency})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (r *CreateOrderRequest) orderItems() []OrderItemRequest {
+	if len(r.Items) == 0 && r.ProductId != "" {
+		return []OrderItemRequest{{ProductId: r.ProductId, Quantity: r.Quantity}}
+	}
+	return r.Items
 }
 
 // HandleOrderCreate handles the creation of a new order
 // @Summary Create a new order
-// @Description Create a new order with customer ID, product ID, and quantity
+// @Description Create a new order with customer ID and a list of product IDs and quantities
 // @Tags orders
 // @Accept json
 // @Produce json
 // @Param request body CreateOrderRequest true "Order request"
+// @Param Idempotency-Key header string false "Key to safely retry the request"
 // @Success 201 {object} Order
+// @Failure 409 {object} ApiError
+// @Failure 422 {object} ApiError
 // @Router /orders [post]
 func (s *APIServer) HandleOrderCreate(w http.ResponseWriter, r *http.Request) error {
 
@@ -71,29 +199,63 @@ func (s *APIServer) HandleOrderCreate(w http.ResponseWriter, r *http.Request) er
 		return err
 	}
 
-	order, err := s.svc.CreateOrder(req.CustomerId, req.ProductId, req.Quantity)
-	if err != nil {
-		return err
-	}
+	var idempotencyKey *IdempotencyKey
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			return fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+		}
 
-	// Publish message to RabbitMQ
-	body, err := json.Marshal(common.PaymentRequest{
-		OrderID:    order.ID,
-		TotalPrice: order.TotalPrice,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal order: %v", err)
+		requestHash, err := req.hash()
+		if err != nil {
+			return err
+		}
+
+		if replayed, err := s.replayIdempotentRequest(r.Context(), w, key, requestHash); replayed || err != nil {
+			return err
+		}
+		idempotencyKey = NewIdempotencyKey(key, requestHash)
 	}
 
-	err = s.rabbitmqSvc.Publish(s.config.OrdersQueue, body, s.config.PaymentsStatusQueue, requestID)
+	order, err := s.svc.CreateOrder(r.Context(), req.CustomerId, req.Currency, req.orderItems(), requestID, idempotencyKey)
+	if errors.Is(err, ErrIdempotencyKeyExists) {
+		// A concurrent request with the same key won the race
+		if replayed, err := s.replayIdempotentRequest(r.Context(), w, idempotencyKey.Key, idempotencyKey.RequestHash); replayed || err != nil {
+			return err
+		}
+	}
 	if err != nil {
 		return err
 	}
 
+	// Payment request was saved to the outbox with the order, publish it right away
+	s.outbox.Notify()
+
 	log.Printf("[%s] order %s in queue for processing", requestID, order.ID)
 	return WriteJSONResponse(w, http.StatusCreated, order)
 }
 
+// replayIdempotentRequest writes the stored response of an earlier request with the
+// same idempotency key. It reports false if the key has not been used yet.
+func (s *APIServer) replayIdempotentRequest(ctx context.Context, w http.ResponseWriter, key, requestHash string) (bool, error) {
+	stored, err := s.svc.GetIdempotencyKey(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if stored.RequestHash != requestHash {
+		return false, ErrIdempotencyKeyReused
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.StatusCode)
+	_, err = w.Write(stored.Response)
+	return true, err
+}
+
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
 type ApiError struct {
@@ -103,11 +265,45 @@ type ApiError struct {
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSONResponse(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			// Postgres reports canceled queries with its own error, so check the request context too
+			if ctxErr := r.Context().Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+				err = fmt.Errorf("request aborted: %w", ctxErr)
+			}
+			WriteJSONResponse(w, errorStatusCode(err), ApiError{Error: err.Error()})
 		}
 	}
 }
 
+// errorStatusCode maps service errors to HTTP status codes
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrIdempotencyKeyReused), errors.Is(err, ErrNoExchangeRate):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrOrderStatusChanged), errors.Is(err, ErrProductRetired), errors.Is(err, ErrEmailTaken),
+		errors.Is(err, ErrInsufficientStock), errors.Is(err, ErrIdempotencyKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), errors.Is(err, ErrClockMovedBackwards):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// TimeoutMiddleware cancels the context of a request after timeout. The context is
+// also canceled when the client disconnects, which cancels its queries and publishes.
+func TimeoutMiddleware(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func WriteJSONResponse(w http.ResponseWriter, status int, v any) error {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -117,23 +313,498 @@ func WriteJSONResponse(w http.ResponseWriter, status int, v any) error {
 
 // HandleOrderRetrieve handles the retrieval of an order by ID
 func (s *APIServer) HandleOrderRetrieve(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+	id, err := getOrderID(r)
 	if err != nil {
 		return err
 
 	}
 
-	order, err := s.svc.GetOrder(id)
+	order, err := s.svc.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, order)
+}
+
+// HandleOrderCancel handles customer initiated cancellation of an order
+// @Summary Cancel an order
+// @Description Cancel a pending order, void the payment of an authorized order, or request a refund for a paid order
+// @Tags orders
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} Order
+// @Failure 409 {object} ApiError
+// @Router /orders/{id}/cancel [post]
+func (s *APIServer) HandleOrderCancel(w http.ResponseWriter, r *http.Request) error {
+	requestID := r.Header.Get("X-Request-ID")
+
+	id, err := getOrderID(r)
+	if err != nil {
+		return err
+	}
+
+	order, err := s.svc.CancelOrder(r.Context(), id, requestID)
+	if err != nil {
+		return err
+	}
+
+	// Voids and refunds are saved to the outbox with the status, publish them right away
+	s.outbox.Notify()
+
+	log.Printf("[%s] order %s moved to %s", requestID, order.ID, order.Status)
+	return WriteJSONResponse(w, http.StatusOK, order)
+}
+
+// HandleOrderFulfill handles the fulfillment of an authorized order
+// @Summary Fulfill an order
+// @Description Capture the authorized payment of an order
+// @Tags orders
+// @Produce json
+// @Param id path string true "Order ID"
+// @Success 200 {object} Order
+// @Failure 409 {object} ApiError
+// @Router /orders/{id}/fulfill [post]
+func (s *APIServer) HandleOrderFulfill(w http.ResponseWriter, r *http.Request) error {
+	id, err := getOrderID(r)
+	if err != nil {
+		return err
+	}
+
+	requestID := r.Header.Get("X-Request-ID")
+	order, err := s.svc.FulfillOrder(r.Context(), id, requestID)
 	if err != nil {
 		return err
 	}
 
+	// The capture was saved to the outbox with the status, publish it right away
+	s.outbox.Notify()
+
+	log.Printf("[%s] order %s moved to %s", requestID, order.ID, order.Status)
 	return WriteJSONResponse(w, http.StatusOK, order)
 }
 
-// ProcessPaymentsWorker Handles Payment responses from payment processing microservice
-func (s *APIServer) ProcessPaymentsWorker() {
-	err := s.rabbitmqSvc.Consume(s.config.PaymentsStatusQueue, func(msgs <-chan amqp.Delivery) {
+// HandleOrderList handles listing of orders
+// @Summary List orders
+// @Description List orders filtered by customer, product, status and creation time with cursor pagination
+// @Tags orders
+// @Produce json
+// @Param customerId query string false "Customer ID"
+// @Param productId query string false "Product ID"
+// @Param status query string false "Order status"
+// @Param createdFrom query string false "Created at or after (RFC3339)"
+// @Param createdTo query string false "Created before (RFC3339)"
+// @Param sortBy query string false "createdAt or updatedAt"
+// @Param order query string false "asc or desc"
+// @Param limit query int false "Page size"
+// @Param cursor query string false "Cursor from a previous page"
+// @Success 200 {object} OrderPage
+// @Router /orders [get]
+func (s *APIServer) HandleOrderList(w http.ResponseWriter, r *http.Request) error {
+	filter, err := getOrderFilter(r)
+	if err != nil {
+		return err
+	}
+
+	page, err := s.svc.ListOrders(r.Context(), *filter)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, page)
+}
+
+type ProductRequest struct {
+	Name  string       `json:"name"`
+	Price common.Money `json:"price"`
+
+	// Prices in other currencies, orders in currencies without a price use exchange rates
+	Prices []common.Money `json:"prices,omitempty"`
+}
+
+// HandleProductCreate handles the creation of a new product
+// @Summary Create a new product
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param request body ProductRequest true "Product request"
+// @Success 201 {object} Product
+// @Router /products [post]
+func (s *APIServer) HandleProductCreate(w http.ResponseWriter, r *http.Request) error {
+	var req ProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	product, err := s.svc.CreateProduct(r.Context(), req.Name, req.Price, req.Prices)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusCreated, product)
+}
+
+// HandleProductList handles listing of products
+// @Summary List products
+// @Tags products
+// @Produce json
+// @Param includeDeleted query bool false "Include deleted products"
+// @Param limit query int false "Page size"
+// @Param cursor query string false "Cursor from a previous page"
+// @Success 200 {object} ProductPage
+// @Router /products [get]
+func (s *APIServer) HandleProductList(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	filter := ProductFilter{Cursor: query.Get("cursor")}
+
+	var err error
+	if filter.IncludeDeleted, err = getIncludeDeleted(r); err != nil {
+		return err
+	}
+	if filter.Limit, err = getLimit(r); err != nil {
+		return err
+	}
+
+	page, err := s.svc.ListProducts(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, page)
+}
+
+// HandleProductRetrieve handles the retrieval of a product by ID, including deleted products
+func (s *APIServer) HandleProductRetrieve(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	product, err := s.svc.GetProduct(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, product)
+}
+
+// HandleProductUpdate handles updating the name and price of a product
+// @Summary Update a product
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body ProductRequest true "Product request"
+// @Success 200 {object} Product
+// @Router /products/{id} [put]
+func (s *APIServer) HandleProductUpdate(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req ProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	product, err := s.svc.UpdateProduct(r.Context(), id, req.Name, req.Price, req.Prices)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, product)
+}
+
+// HandleProductDelete handles soft deletion of a product
+// @Summary Delete a product
+// @Tags products
+// @Param id path string true "Product ID"
+// @Success 204
+// @Router /products/{id} [delete]
+func (s *APIServer) HandleProductDelete(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.svc.DeleteProduct(r.Context(), id); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type InventoryRequest struct {
+	OnHand int64 `json:"onHand"`
+}
+
+// HandleInventoryRetrieve handles the retrieval of the stock level of a product
+// @Summary Get product stock
+// @Tags products
+// @Produce json
+// @Param id path string true "Product ID"
+// @Success 200 {object} Inventory
+// @Router /products/{id}/inventory [get]
+func (s *APIServer) HandleInventoryRetrieve(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	inventory, err := s.svc.GetInventory(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, inventory)
+}
+
+// HandleInventoryUpdate handles setting the stock on hand of a product
+// @Summary Set product stock
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body InventoryRequest true "Inventory request"
+// @Success 200 {object} Inventory
+// @Router /products/{id}/inventory [put]
+func (s *APIServer) HandleInventoryUpdate(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req InventoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	inventory, err := s.svc.SetInventory(r.Context(), id, req.OnHand)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, inventory)
+}
+
+type CustomerRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// HandleCustomerCreate handles the creation of a new customer
+// @Summary Create a new customer
+// @Tags customers
+// @Accept json
+// @Produce json
+// @Param request body CustomerRequest true "Customer request"
+// @Success 201 {object} Customer
+// @Failure 409 {object} ApiError
+// @Router /customers [post]
+func (s *APIServer) HandleCustomerCreate(w http.ResponseWriter, r *http.Request) error {
+	var req CustomerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	customer, err := s.svc.CreateCustomer(r.Context(), req.Name, req.Email)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusCreated, customer)
+}
+
+// HandleCustomerList handles listing of customers
+// @Summary List customers
+// @Tags customers
+// @Produce json
+// @Param includeDeleted query bool false "Include deleted customers"
+// @Param limit query int false "Page size"
+// @Param cursor query string false "Cursor from a previous page"
+// @Success 200 {object} CustomerPage
+// @Router /customers [get]
+func (s *APIServer) HandleCustomerList(w http.ResponseWriter, r *http.Request) error {
+	filter := CustomerFilter{Cursor: r.URL.Query().Get("cursor")}
+
+	var err error
+	if filter.IncludeDeleted, err = getIncludeDeleted(r); err != nil {
+		return err
+	}
+	if filter.Limit, err = getLimit(r); err != nil {
+		return err
+	}
+
+	page, err := s.svc.ListCustomers(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, page)
+}
+
+// HandleCustomerRetrieve handles the retrieval of a customer by ID
+func (s *APIServer) HandleCustomerRetrieve(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	customer, err := s.svc.GetCustomer(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, customer)
+}
+
+// HandleCustomerUpdate handles updating the name and email of a customer
+// @Summary Update a customer
+// @Tags customers
+// @Accept json
+// @Produce json
+// @Param id path string true "Customer ID"
+// @Param request body CustomerRequest true "Customer request"
+// @Success 200 {object} Customer
+// @Failure 409 {object} ApiError
+// @Router /customers/{id} [put]
+func (s *APIServer) HandleCustomerUpdate(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CustomerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	customer, err := s.svc.UpdateCustomer(r.Context(), id, req.Name, req.Email)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, customer)
+}
+
+// HandleCustomerDelete handles soft deletion of a customer
+// @Summary Delete a customer
+// @Tags customers
+// @Param id path string true "Customer ID"
+// @Success 204
+// @Router /customers/{id} [delete]
+func (s *APIServer) HandleCustomerDelete(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.svc.DeleteCustomer(r.Context(), id); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleCustomerOrders handles listing the order history of a customer
+// @Summary List orders of a customer
+// @Description Accepts the same query parameters as GET /orders, except customerId
+// @Tags customers
+// @Produce json
+// @Param id path string true "Customer ID"
+// @Success 200 {object} OrderPage
+// @Router /customers/{id}/orders [get]
+func (s *APIServer) HandleCustomerOrders(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	filter, err := getOrderFilter(r)
+	if err != nil {
+		return err
+	}
+
+	page, err := s.svc.ListCustomerOrders(r.Context(), id, *filter)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, page)
+}
+
+type ExchangeRateRequest struct {
+	BaseCurrency  string `json:"baseCurrency"`
+	QuoteCurrency string `json:"quoteCurrency"`
+	Rate          string `json:"rate"`
+
+	// EffectiveFrom is optional, the rate takes effect immediately when it is not set
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+}
+
+// HandleExchangeRateCreate handles adding an exchange rate
+// @Summary Add an exchange rate
+// @Tags exchange-rates
+// @Accept json
+// @Produce json
+// @Param request body ExchangeRateRequest true "Exchange rate request"
+// @Success 201 {object} ExchangeRate
+// @Router /exchange-rates [post]
+func (s *APIServer) HandleExchangeRateCreate(w http.ResponseWriter, r *http.Request) error {
+	var req ExchangeRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	rate, err := s.svc.CreateExchangeRate(r.Context(), req.BaseCurrency, req.QuoteCurrency, req.Rate, req.EffectiveFrom)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusCreated, rate)
+}
+
+// HandleExchangeRateRetrieve handles the retrieval of the exchange rate of a currency pair
+// @Summary Get the exchange rate in effect
+// @Tags exchange-rates
+// @Produce json
+// @Param base path string true "Base currency"
+// @Param quote path string true "Quote currency"
+// @Param at query string false "Time the rate is in effect at (RFC3339), default now"
+// @Success 200 {object} ExchangeRate
+// @Router /exchange-rates/{base}/{quote} [get]
+func (s *APIServer) HandleExchangeRateRetrieve(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+
+	at := time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("invalid at given %s", value)
+		}
+	}
+
+	rate, err := s.svc.GetExchangeRate(r.Context(), vars["base"], vars["quote"], at)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, rate)
+}
+
+// ProcessPaymentsWorker Handles Payment responses from payment processing microservice until ctx is canceled
+func (s *APIServer) ProcessPaymentsWorker(ctx context.Context) {
+	opts := common.ConsumeOptions{
+		Workers:  s.config.ConsumerWorkers,
+		Prefetch: s.config.ConsumerPrefetch,
+		Key:      common.OrderKey,
+	}
+
+	// Responses of the same order are handled in order by the same worker
+	err := s.rabbitmqSvc.Consume(ctx, s.config.PaymentsStatusQueue, opts, func(msgs <-chan amqp.Delivery) {
 		for d := range msgs {
 			// Get correlation id for logging
 			requesId := d.CorrelationId
@@ -142,20 +813,45 @@ func (s *APIServer) ProcessPaymentsWorker() {
 			err := json.Unmarshal(d.Body, &response)
 			if err != nil {
 				log.Printf("[%s] Failed to decode message error: %v", requesId, err)
-				d.Ack(false)
+				s.deadLetter(context.Background(), d, err)
 				continue
 			}
 
+			orderId, err := ParseOrderID(response.OrderID)
+			if err != nil {
+				log.Printf("[%s] Failed to decode message error: %v", requesId, err)
+				s.deadLetter(context.Background(), d, err)
+				continue
+			}
+
+			// Every message gets its own deadline. The consumer context is not used, so a
+			// message already taken from the queue is still handled during shutdown.
+			msgCtx, cancel := context.WithTimeout(context.Background(), s.config.RequestTimeout)
+
 			// Update order status as per business logic
-			err = s.svc.UpdateOrderStatus(response.OrderID, response.PaymentStatus)
+			err = s.svc.UpdateOrderStatus(msgCtx, orderId, response, requesId)
+			cancel()
 			if err != nil {
 				log.Printf("[%s] Failed to update order status for order id: %s error: %v", requesId, response.OrderID, err)
-				d.Ack(false)
+				// Not bound to msgCtx, so responses that ran out of time can still be retried
+				if isPermanentPaymentError(err) {
+					s.deadLetter(context.Background(), d, err)
+				} else {
+					s.retry(context.Background(), d, err)
+				}
 				continue
 			}
 
+			// Voids enqueued by the response, for orders canceled during their authorization
+			// or whose capture failed, are in the outbox
+			s.outbox.Notify()
+
 			d.Ack(false)
-			log.Printf("[%s] Payment for order id %s is %s", requesId, response.OrderID, response.PaymentStatus)
+			if response.Reason != "" {
+				log.Printf("[%s] Payment for order id %s is %s: %s", requesId, response.OrderID, response.PaymentStatus, response.Reason)
+			} else {
+				log.Printf("[%s] Payment for order id %s is %s", requesId, response.OrderID, response.PaymentStatus)
+			}
 		}
 	})
 	if err != nil {
@@ -164,6 +860,27 @@ func (s *APIServer) ProcessPaymentsWorker() {
 
 }
 
+// isPermanentPaymentError reports whether a payment response can never be applied,
+// such as a response for an unknown order or a late response for a canceled order.
+// Responses for orders whose status kept changing while they were applied are retried.
+func isPermanentPaymentError(err error) bool {
+	return errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrInvalidTransition) ||
+		errors.Is(err, ErrInvalidPaymentStatus)
+}
+
+func (s *APIServer) retry(ctx context.Context, d amqp.Delivery, reason error) {
+	if err := s.rabbitmqSvc.Retry(ctx, s.config.PaymentsStatusQueue, d, reason); err != nil {
+		log.Printf("[%s] Failed to retry payment response: %v", d.CorrelationId, err)
+	}
+}
+
+func (s *APIServer) deadLetter(ctx context.Context, d amqp.Delivery, reason error) {
+	if err := s.rabbitmqSvc.DeadLetter(ctx, s.config.PaymentsStatusQueue, d, reason); err != nil {
+		log.Printf("[%s] Failed to dead-letter payment response: %v", d.CorrelationId, err)
+	}
+}
+
 func getID(r *http.Request) (int, error) {
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
@@ -172,3 +889,77 @@ func getID(r *http.Request) (int, error) {
 	}
 	return id, nil
 }
+
+func getOrderID(r *http.Request) (OrderID, error) {
+	return ParseOrderID(mux.Vars(r)["id"])
+}
+
+func getOrderFilter(r *http.Request) (*OrderFilter, error) {
+	query := r.URL.Query()
+
+	filter := &OrderFilter{
+		CustomerId: query.Get("customerId"),
+		ProductId:  query.Get("productId"),
+		Status:     query.Get("status"),
+		SortBy:     query.Get("sortBy"),
+		Cursor:     query.Get("cursor"),
+	}
+
+	for param, dest := range map[string]**time.Time{
+		"createdFrom": &filter.CreatedFrom,
+		"createdTo":   &filter.CreatedTo,
+	} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s given %s", param, value)
+		}
+		*dest = &t
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return nil, fmt.Errorf("invalid order given %s", order)
+	}
+
+	limit, err := getLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	filter.Limit = limit
+
+	return filter, nil
+}
+
+func getIncludeDeleted(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("includeDeleted")
+	if value == "" {
+		return false, nil
+	}
+
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid includeDeleted given %s", value)
+	}
+	return includeDeleted, nil
+}
+
+// getLimit returns the page size query parameter, or 0 when it is not set
+func getLimit(r *http.Request) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit given %s", limitStr)
+	}
+	return limit, nil
+}
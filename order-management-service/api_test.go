@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// newTestAPIServer returns an API server on the in-memory storage and broker,
+// with the customer and product stored by seedStorage
+func newTestAPIServer(t *testing.T) (*APIServer, *MemoryStore, *Customer, *Product) {
+	t.Helper()
+
+	repo := NewMemoryStore()
+	customer, product := seedStorage(t, repo)
+
+	mq := common.NewMemoryMQService(common.Exchange{})
+	t.Cleanup(mq.Close)
+
+	config := &ServerConfig{OrdersQueue: "processingorders", PaymentsStatusQueue: "paymentstatus"}
+	server := NewAPIServer(config, mq, NewOrderManagementService(repo, config, newTestIDs(t)), NewOutboxRelay(repo, mq))
+	return server, repo, customer, product
+}
+
+// postOrder sends body to HandleOrderCreate with the idempotency key, if any
+func postOrder(server *APIServer, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.HandleOrderCreate)(rec, req)
+	return rec
+}
+
+func TestHandleOrderCreateIdempotency(t *testing.T) {
+	ctx := context.Background()
+	server, repo, customer, product := newTestAPIServer(t)
+
+	items := `{"customerId": "` + customer.CustomerId + `", "items": [{"productId": "` + product.ProductId + `", "quantity": 1}]}`
+	shorthand := `{"customerId":"` + customer.CustomerId + `","productId":"` + product.ProductId + `","quantity":1}`
+	other := `{"customerId": "` + customer.CustomerId + `", "items": [{"productId": "` + product.ProductId + `", "quantity": 2}]}`
+
+	first := postOrder(server, "order-1", items)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first request = %d %s, want %d", first.Code, first.Body, http.StatusCreated)
+	}
+	firstBody := strings.TrimSpace(first.Body.String())
+
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		wantCode     int
+		wantReplayed bool
+	}{
+		{name: "same request", key: "order-1", body: items, wantCode: http.StatusCreated, wantReplayed: true},
+		{name: "single product shorthand", key: "order-1", body: shorthand, wantCode: http.StatusCreated, wantReplayed: true},
+		{name: "different request", key: "order-1", body: other, wantCode: http.StatusUnprocessableEntity},
+		{name: "new key", key: "order-2", body: items, wantCode: http.StatusCreated},
+		{name: "no key", body: items, wantCode: http.StatusCreated},
+		{name: "long key", key: strings.Repeat("k", maxIdempotencyKeyLength+1), body: items, wantCode: http.StatusBadRequest},
+	}
+
+	wantOrders := 1
+	for _, tt := range tests {
+		rec := postOrder(server, tt.key, tt.body)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status %d %s, want %d", tt.name, rec.Code, rec.Body, tt.wantCode)
+			continue
+		}
+
+		replayed := rec.Header().Get("Idempotent-Replayed") == "true"
+		if replayed != tt.wantReplayed {
+			t.Errorf("%s: replayed %v, want %v", tt.name, replayed, tt.wantReplayed)
+		}
+		if tt.wantReplayed && strings.TrimSpace(rec.Body.String()) != firstBody {
+			t.Errorf("%s: response %s, want the first response %s", tt.name, rec.Body, firstBody)
+		}
+		if rec.Code == http.StatusCreated && !tt.wantReplayed {
+			wantOrders++
+		}
+	}
+
+	// Replayed requests create neither orders nor payment requests
+	orders, err := repo.ListOrders(ctx, OrderFilter{SortBy: SortByCreatedAt, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != wantOrders {
+		t.Errorf("%d orders created, want %d", len(orders), wantOrders)
+	}
+	messages, err := repo.ClaimOutboxMessages(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != wantOrders {
+		t.Errorf("%d payment requests saved, want %d", len(messages), wantOrders)
+	}
+}
+
+func TestCreateOrderRequestHash(t *testing.T) {
+	decode := func(body string) *CreateOrderRequest {
+		req := new(CreateOrderRequest)
+		if err := json.NewDecoder(bytes.NewBufferString(body)).Decode(req); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	base := `{"customerId":"1","items":[{"productId":"2","quantity":1}]}`
+	tests := []struct {
+		body string
+		same bool
+	}{
+		{body: base, same: true},
+		{body: "{\n  \"items\": [{\"quantity\": 1, \"productId\": \"2\"}],\n  \"customerId\": \"1\"\n}", same: true},
+		{body: `{"customerId":"1","productId":"2","quantity":1}`, same: true},
+		{body: `{"customerId":"1","items":[{"productId":"2","quantity":1}],"currency":"USD"}`, same: true},
+		{body: `{"customerId":"1","items":[{"productId":"2","quantity":1}],"currency":"EUR"}`, same: false},
+		{body: `{"customerId":"1","items":[{"productId":"2","quantity":2}]}`, same: false},
+		{body: `{"customerId":"3","items":[{"productId":"2","quantity":1}]}`, same: false},
+		{body: `{"customerId":"1","items":[{"productId":"2","quantity":1},{"productId":"4","quantity":1}]}`, same: false},
+	}
+
+	want, err := decode(base).hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		got, err := decode(tt.body).hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == want) != tt.same {
+			t.Errorf("hash of %s matches %v, want %v", tt.body, got == want, tt.same)
+		}
+	}
+}
+
+func TestIsPermanentPaymentError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: fmt.Errorf("order id 7 %w", ErrNotFound), want: true},
+		{err: fmt.Errorf("%w: order 7 is no longer Pending", ErrInvalidTransition), want: true},
+		{err: fmt.Errorf("%w: lost", ErrInvalidPaymentStatus), want: true},
+		{err: fmt.Errorf("%w: order 7 is no longer Pending", ErrOrderStatusChanged), want: false},
+		{err: errors.New("connection refused"), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isPermanentPaymentError(tt.err); got != tt.want {
+			t.Errorf("isPermanentPaymentError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,33 +1,85 @@
 package main
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultRequestTimeout is used when REQUEST_TIMEOUT is not set
+const defaultRequestTimeout = 10 * time.Second
 
 type ServerConfig struct {
 	AmqpUrl             string
 	ExchangeName        string
+	ExchangeType        string
 	OrdersQueue         string
 	PaymentsStatusQueue string
 	Port                string
+	NodeId              string
+
+	// Payment responses handled concurrently, 0 uses the defaults of common.ConsumeOptions
+	ConsumerWorkers  int
+	ConsumerPrefetch int
+
+	// RequestTimeout is the deadline of an API request or a payment response
+	RequestTimeout time.Duration
 }
 
 type DbConfig struct {
-	User     string
-	Password string
-	Name     string
-	Host     string
+	StorageType string
+	User        string
+	Password    string
+	Name        string
+	Host        string
 }
 
 func InitConfig() (*ServerConfig, *DbConfig) {
 	return &ServerConfig{
 			AmqpUrl:             os.Getenv(amqpUrlStr),
 			ExchangeName:        os.Getenv(exchangeNameStr),
+			ExchangeType:        os.Getenv(exchangeTypeStr),
 			OrdersQueue:         os.Getenv(sendRoutingKeyStr),
 			PaymentsStatusQueue: os.Getenv(receiveRoutingKeyStr),
 			Port:                os.Getenv(portStr),
+			NodeId:              os.Getenv(nodeIdStr),
+			ConsumerWorkers:     intFromEnv(consumerWorkersStr),
+			ConsumerPrefetch:    intFromEnv(consumerPrefetchStr),
+			RequestTimeout:      durationFromEnv(requestTimeoutStr, defaultRequestTimeout),
 		}, &DbConfig{
-			User:     os.Getenv(pgUserStr),
-			Password: os.Getenv(pgPassStr),
-			Name:     os.Getenv(pgDbStr),
-			Host:     os.Getenv(dbHostStr),
+			StorageType: os.Getenv(storageTypeStr),
+			User:        os.Getenv(pgUserStr),
+			Password:    os.Getenv(pgPassStr),
+			Name:        os.Getenv(pgDbStr),
+			Host:        os.Getenv(dbHostStr),
 		}
 }
+
+// intFromEnv reads an optional non negative number from the environment
+func intFromEnv(key string) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid value of %s: %s", key, value)
+	}
+	return n
+}
+
+// durationFromEnv reads an optional positive duration such as 10s from the environment
+func durationFromEnv(key string, value time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return value
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid value of %s: %s", key, v)
+	}
+	return d
+}
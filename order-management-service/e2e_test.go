@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+	"github.com/aayush993/go-order-management/payment-processing-service/payments"
+	"github.com/gorilla/mux"
+)
+
+const (
+	e2eOrdersQueue   = "processingorders"
+	e2ePaymentsQueue = "paymentstatus"
+)
+
+// e2e runs the order API, the outbox relay and the payment processing service
+// against the in-memory storage and broker in one process
+type e2e struct {
+	t         *testing.T
+	ctx       context.Context
+	mq        *common.MemoryMQService
+	server    *APIServer
+	relay     *OutboxRelay
+	repo      *MemoryStore
+	customer  *Customer
+	product   *Product
+	productId int
+}
+
+func newE2E(t *testing.T) *e2e {
+	t.Helper()
+
+	// Canceled when the test ends, it stops the consumers
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	repo := NewMemoryStore()
+	customer := NewCustomer("Jane", "jane@example.com")
+	if err := repo.CreateCustomer(ctx, customer); err != nil {
+		t.Fatal(err)
+	}
+	product := NewProduct("Mug", usd("10"), nil)
+	if err := repo.CreateProduct(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	productId, _ := strconv.Atoi(product.ProductId)
+	if _, err := repo.SetInventory(ctx, productId, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	mq := common.NewMemoryMQService(common.Exchange{})
+	config := &ServerConfig{OrdersQueue: e2eOrdersQueue, PaymentsStatusQueue: e2ePaymentsQueue}
+	relay := NewOutboxRelay(repo, mq)
+	server := NewAPIServer(config, mq, NewOrderManagementService(repo, config, newTestIDs(t)), relay)
+	go server.ProcessPaymentsWorker(ctx)
+	t.Cleanup(mq.Close)
+
+	return &e2e{t: t, ctx: ctx, mq: mq, server: server, relay: relay, repo: repo, customer: customer, product: product, productId: productId}
+}
+
+// startPayments starts consuming payment requests, requests delivered before
+// are handled in order
+func (e *e2e) startPayments() {
+	go e.mq.Consume(e.ctx, e2eOrdersQueue, common.DefaultConsumeOptions, payments.PaymentsWorker(e.mq, e2eOrdersQueue, payments.NewThresholdProcessor(map[string]common.Money{common.DefaultCurrency: usd("1000")})))
+}
+
+// deliver publishes the outbox and waits until both services handled every message
+func (e *e2e) deliver() {
+	e.t.Helper()
+	e.relay.publishPending(e.ctx)
+	if !e.mq.WaitIdle(5 * time.Second) {
+		e.t.Fatal("messages still being handled after 5s")
+	}
+}
+
+// call runs handler with the request and decodes the order it answers with
+func (e *e2e) call(handler apiFunc, method, target, orderId string, body any, wantCode int) *Order {
+	e.t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, &reqBody)
+	if orderId != "" {
+		req = mux.SetURLVars(req, map[string]string{"id": orderId})
+	}
+
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(handler)(rec, req)
+	if rec.Code != wantCode {
+		e.t.Fatalf("%s %s = %d %s, want %d", method, target, rec.Code, rec.Body, wantCode)
+	}
+
+	order := new(Order)
+	if err := json.NewDecoder(rec.Body).Decode(order); err != nil {
+		e.t.Fatal(err)
+	}
+	return order
+}
+
+func (e *e2e) createOrder(quantity int64) *Order {
+	e.t.Helper()
+	req := CreateOrderRequest{
+		CustomerId: e.customer.CustomerId,
+		Items:      []OrderItemRequest{{ProductId: e.product.ProductId, Quantity: quantity}},
+	}
+	return e.call(e.server.HandleOrderCreate, http.MethodPost, "/orders", "", req, http.StatusCreated)
+}
+
+func (e *e2e) cancelOrder(id OrderID) *Order {
+	e.t.Helper()
+	return e.call(e.server.HandleOrderCancel, http.MethodPost, "/orders/"+id.String()+"/cancel", id.String(), nil, http.StatusOK)
+}
+
+func (e *e2e) fulfillOrder(id OrderID) *Order {
+	e.t.Helper()
+	return e.call(e.server.HandleOrderFulfill, http.MethodPost, "/orders/"+id.String()+"/fulfill", id.String(), nil, http.StatusOK)
+}
+
+func (e *e2e) getOrder(id OrderID) *Order {
+	e.t.Helper()
+	return e.call(e.server.HandleOrderRetrieve, http.MethodGet, "/orders/"+id.String(), id.String(), nil, http.StatusOK)
+}
+
+func TestEndToEndOrderPayments(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity int64
+		// cancelPending cancels the order before the payment service runs
+		cancelPending bool
+		// actions are applied to the authorized order in turn, the payment
+		// requests they save are delivered after each of them
+		actions []string
+
+		wantStatus    string
+		wantOnHand    int64
+		wantAvailable int64
+	}{
+		{
+			name:          "authorized",
+			quantity:      2,
+			wantStatus:    OrderAuthorized,
+			wantOnHand:    1000,
+			wantAvailable: 998,
+		},
+		{
+			name:          "declined",
+			quantity:      150,
+			wantStatus:    OrderCanceled,
+			wantOnHand:    1000,
+			wantAvailable: 1000,
+		},
+		{
+			// The late authorization does not move the canceled order, its hold is voided
+			name:          "canceled before authorization",
+			quantity:      2,
+			cancelPending: true,
+			wantStatus:    OrderCanceled,
+			wantOnHand:    1000,
+			wantAvailable: 1000,
+		},
+		{
+			name:          "fulfilled",
+			quantity:      2,
+			actions:       []string{"fulfill"},
+			wantStatus:    OrderFulfilled,
+			wantOnHand:    998,
+			wantAvailable: 998,
+		},
+		{
+			name:          "canceled after authorization",
+			quantity:      2,
+			actions:       []string{"cancel"},
+			wantStatus:    OrderCanceled,
+			wantOnHand:    1000,
+			wantAvailable: 1000,
+		},
+		{
+			// Refunded units are not put back in stock, they were shipped
+			name:          "refunded after fulfillment",
+			quantity:      2,
+			actions:       []string{"fulfill", "cancel"},
+			wantStatus:    OrderRefunded,
+			wantOnHand:    998,
+			wantAvailable: 998,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newE2E(t)
+
+			order := e.createOrder(tt.quantity)
+			if order.Status != OrderPending {
+				t.Fatalf("created order is %s, want %s", order.Status, OrderPending)
+			}
+
+			// Without a consumer the payment request waits on its queue
+			e.relay.publishPending(e.ctx)
+
+			if tt.cancelPending {
+				if canceled := e.cancelOrder(order.ID); canceled.Status != OrderCanceled {
+					t.Fatalf("canceled pending order is %s, want %s", canceled.Status, OrderCanceled)
+				}
+			}
+
+			e.startPayments()
+			e.deliver()
+
+			for _, action := range tt.actions {
+				switch action {
+				case "fulfill":
+					e.fulfillOrder(order.ID)
+				case "cancel":
+					e.cancelOrder(order.ID)
+				}
+				e.deliver()
+			}
+
+			if got := e.getOrder(order.ID); got.Status != tt.wantStatus {
+				t.Errorf("order is %s, want %s", got.Status, tt.wantStatus)
+			}
+
+			inventory, err := e.repo.GetInventory(e.ctx, e.productId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inventory.OnHand != tt.wantOnHand || inventory.Available != tt.wantAvailable {
+				t.Errorf("inventory = %+v, want %d on hand and %d available", inventory, tt.wantOnHand, tt.wantAvailable)
+			}
+
+			for _, queue := range []string{e2eOrdersQueue, e2ePaymentsQueue} {
+				if n := e.mq.QueueLength(common.DeadLetterQueueName(queue)); n != 0 {
+					t.Errorf("%d messages dead-lettered from %s", n, queue)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OrderID identifies an order. IDs are 64 bit integers stored as bigint and
+// encoded as JSON strings, since they do not fit in a JavaScript number.
+type OrderID int64
+
+func ParseOrderID(s string) (OrderID, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid order id %s", s)
+	}
+	return OrderID(id), nil
+}
+
+func (id OrderID) String() string {
+	return strconv.FormatInt(int64(id), 10)
+}
+
+func (id OrderID) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(id.String())), nil
+}
+
+func (id *OrderID) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid order id %s", b)
+	}
+
+	parsed, err := ParseOrderID(s)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// IDGenerator generates order IDs that are unique across OMS replicas
+type IDGenerator interface {
+	NextID() (OrderID, error)
+}
+
+// ErrClockMovedBackwards is returned when no id can be generated until the clock
+// catches up with the last millisecond ids were generated in
+var ErrClockMovedBackwards = errors.New("clock moved backwards")
+
+// Snowflake ID layout: 41 bits of milliseconds since snowflakeEpoch,
+// 10 bits of node id and 12 bits of per millisecond sequence.
+// IDs generated later sort after earlier ones.
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+
+	maxSnowflakeNode     = 1<<snowflakeNodeBits - 1
+	maxSnowflakeSequence = 1<<snowflakeSequenceBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxSnowflakeWait bounds how long NextID waits for the clock to reach the next
+// millisecond once the sequence of the last one is exhausted
+const maxSnowflakeWait = 100 * time.Millisecond
+
+// SnowflakeGenerator is a thread safe snowflake style IDGenerator. Every
+// replica must use a different node id for IDs to be unique.
+type SnowflakeGenerator struct {
+	mu       sync.Mutex
+	node     int64
+	lastMs   int64
+	sequence int64
+}
+
+func NewSnowflakeGenerator(node int64) (*SnowflakeGenerator, error) {
+	if node < 0 || node > maxSnowflakeNode {
+		return nil, fmt.Errorf("node id must be between 0 and %d", maxSnowflakeNode)
+	}
+
+	return &SnowflakeGenerator{
+		node: node,
+	}, nil
+}
+
+// NextID returns ErrClockMovedBackwards when the sequence of the last millisecond is
+// exhausted and the clock is more than maxSnowflakeWait behind it, as after a clock
+// rollback. Requests then fail instead of waiting for the clock to catch up.
+func (g *SnowflakeGenerator) NextID() (OrderID, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Since(snowflakeEpoch).Milliseconds()
+
+	// Never go back in time, if the clock moved backwards keep using the last millisecond
+	ms := max(now, g.lastMs)
+
+	if ms == g.lastMs {
+		if g.sequence == maxSnowflakeSequence {
+			// Sequence exhausted for this millisecond, wait for the next one
+			if g.lastMs-now >= maxSnowflakeWait.Milliseconds() {
+				return 0, fmt.Errorf("%w: %dms behind the last order id", ErrClockMovedBackwards, g.lastMs-now)
+			}
+
+			deadline := time.Now().Add(maxSnowflakeWait)
+			for ms <= g.lastMs {
+				if time.Now().After(deadline) {
+					return 0, fmt.Errorf("%w: waited %s for the next millisecond", ErrClockMovedBackwards, maxSnowflakeWait)
+				}
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Since(snowflakeEpoch).Milliseconds()
+			}
+			g.sequence = 0
+		} else {
+			g.sequence++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMs = ms
+
+	return OrderID(ms<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence), nil
+}
+
+// nodeIDFromEnv parses the NODE_ID setting. It is required, a node id guessed
+// for a replica could be the one of another replica and repeat its order ids.
+func nodeIDFromEnv(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("%s is required, every replica needs a different one between 0 and %d", nodeIdStr, maxSnowflakeNode)
+	}
+
+	node, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid node id %s", value)
+	}
+	return node, nil
+}
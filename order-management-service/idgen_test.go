@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestIDs returns an id generator for the services and orders created by tests
+func newTestIDs(t *testing.T) *SnowflakeGenerator {
+	t.Helper()
+	ids, err := NewSnowflakeGenerator(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// nextTestID returns the next id of ids for orders created by tests
+func nextTestID(t *testing.T, ids IDGenerator) OrderID {
+	t.Helper()
+	id, err := ids.NextID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// splitOrderID returns the millisecond, node and sequence parts of a snowflake id
+func splitOrderID(id OrderID) (ms, node, sequence int64) {
+	return int64(id) >> (snowflakeNodeBits + snowflakeSequenceBits),
+		int64(id) >> snowflakeSequenceBits & maxSnowflakeNode,
+		int64(id) & maxSnowflakeSequence
+}
+
+func TestNewSnowflakeGenerator(t *testing.T) {
+	tests := []struct {
+		node    int64
+		wantErr bool
+	}{
+		{node: -1, wantErr: true},
+		{node: 0},
+		{node: 512},
+		{node: maxSnowflakeNode},
+		{node: maxSnowflakeNode + 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ids, err := NewSnowflakeGenerator(tt.node)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewSnowflakeGenerator(%d) error = %v, want error %v", tt.node, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, node, _ := splitOrderID(nextTestID(t, ids)); node != tt.node {
+			t.Errorf("id of node %d has node %d", tt.node, node)
+		}
+	}
+}
+
+func TestSnowflakeNextIDIsOrderedAndUnique(t *testing.T) {
+	ids := newTestIDs(t)
+
+	// More ids than fit in a millisecond, so the sequence wraps at least once
+	const n = 3 * (maxSnowflakeSequence + 1)
+	seen := make(map[OrderID]bool, n)
+	last := OrderID(0)
+	for i := 0; i < n; i++ {
+		id := nextTestID(t, ids)
+		if id <= last {
+			t.Fatalf("id %d generated after %d", id, last)
+		}
+		if seen[id] {
+			t.Fatalf("id %d generated twice", id)
+		}
+		seen[id] = true
+		last = id
+	}
+}
+
+func TestSnowflakeNextIDSequence(t *testing.T) {
+	now := time.Since(snowflakeEpoch).Milliseconds()
+
+	tests := []struct {
+		name         string
+		lastMs       int64
+		sequence     int64
+		wantAfterMs  int64
+		wantSequence int64
+		wantErr      error
+	}{
+		// The exhausted sequence waits for the next millisecond and starts over
+		{name: "wrap", lastMs: now, sequence: maxSnowflakeSequence, wantAfterMs: now, wantSequence: 0},
+		// A clock that moved backwards keeps the last millisecond
+		{name: "clock rollback", lastMs: now + 50, sequence: 7, wantAfterMs: now + 49, wantSequence: 8},
+		// A small rollback is waited out once the sequence is exhausted
+		{name: "wrap after small clock rollback", lastMs: now + 20, sequence: maxSnowflakeSequence, wantAfterMs: now + 20, wantSequence: 0},
+		// A large one fails instead of waiting for the clock to catch up
+		{name: "wrap after clock rollback", lastMs: now + 60_000, sequence: maxSnowflakeSequence, wantErr: ErrClockMovedBackwards},
+	}
+
+	for _, tt := range tests {
+		ids := newTestIDs(t)
+		ids.lastMs = tt.lastMs
+		ids.sequence = tt.sequence
+
+		id, err := ids.NextID()
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: NextID() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			// The exhausted sequence is not reused
+			if ids.lastMs != tt.lastMs || ids.sequence != tt.sequence {
+				t.Errorf("%s: failed NextID() moved to millisecond %d sequence %d", tt.name, ids.lastMs, ids.sequence)
+			}
+			continue
+		}
+
+		ms, _, sequence := splitOrderID(id)
+		if ms <= tt.wantAfterMs || sequence != tt.wantSequence {
+			t.Errorf("%s: id of millisecond %d sequence %d, want after %d sequence %d", tt.name, ms, sequence, tt.wantAfterMs, tt.wantSequence)
+		}
+	}
+}
+
+func TestParseOrderID(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    OrderID
+		wantErr bool
+	}{
+		{s: "1", want: 1},
+		{s: "9007199254740993", want: 9007199254740993},
+		{s: "0", wantErr: true},
+		{s: "-4", wantErr: true},
+		{s: "abc", wantErr: true},
+		{s: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOrderID(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseOrderID(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestOrderIDJSON(t *testing.T) {
+	// Ids above 2^53 lose precision as JSON numbers, they are sent as strings
+	id := OrderID(9007199254740993)
+
+	b, err := json.Marshal(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"9007199254740993"` {
+		t.Errorf("json.Marshal(%d) = %s", id, b)
+	}
+
+	var got OrderID
+	if err := json.Unmarshal(b, &got); err != nil || got != id {
+		t.Errorf("json.Unmarshal(%s) = %d, %v, want %d", b, got, err, id)
+	}
+
+	for _, invalid := range []string{`9007199254740993`, `"abc"`, `"0"`} {
+		if err := json.Unmarshal([]byte(invalid), &got); err == nil {
+			t.Errorf("json.Unmarshal(%s) succeeded", invalid)
+		}
+	}
+}
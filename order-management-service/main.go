@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/aayush993/go-order-management/common"
 )
@@ -16,8 +20,20 @@ const (
 	dbHostStr            = "POSTGRES_HOST"
 	portStr              = "PORT"
 	exchangeNameStr      = "EXCHANGE_NAME"
+	exchangeTypeStr      = "EXCHANGE_TYPE"
 	sendRoutingKeyStr    = "SEND_ROUTING_KEY"
 	receiveRoutingKeyStr = "RECEIVE_ROUTING_KEY"
+	storageTypeStr       = "STORAGE_TYPE"
+	nodeIdStr            = "NODE_ID"
+	consumerWorkersStr   = "CONSUMER_WORKERS"
+	consumerPrefetchStr  = "CONSUMER_PREFETCH"
+	requestTimeoutStr    = "REQUEST_TIMEOUT"
+)
+
+// Supported values of STORAGE_TYPE
+const (
+	storagePostgres = "postgres"
+	storageMemory   = "memory"
 )
 
 func main() {
@@ -25,45 +41,115 @@ func main() {
 	// Get config from environment
 	serverConfig, dbConfig := InitConfig()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), dbConfig, os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
 	// Initialize rabbitMQ Client Service
-	rabbitmqService, err := common.NewRabbitMQService(serverConfig.AmqpUrl)
+	exchange, err := common.NewExchange(serverConfig.ExchangeName, serverConfig.ExchangeType)
+	if err != nil {
+		log.Fatalf("Failed to initialize RabbitMQ service: %v", err)
+	}
+	rabbitmqService, err := common.NewRabbitMQService(serverConfig.AmqpUrl, exchange)
 	if err != nil {
 		log.Fatalf("Failed to initialize RabbitMQ service: %v", err)
 	}
 	defer rabbitmqService.Close()
 	log.Printf("[x] Message broker connected")
 
-	// Initialize Postgres Client Service
-	dbStore, err := NewPostgresStore(dbConfig)
+	dbStore := initStorage(dbConfig)
+
+	// seed table with customer and product
+	seedTables(context.Background(), dbStore)
+
+	nodeId, err := nodeIDFromEnv(serverConfig.NodeId)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Failed to initialize order id generator: %v", err)
 	}
-	log.Printf("[x] Database connected")
-
-	if err := dbStore.CreateTables(); err != nil {
-		log.Fatal(err)
+	ids, err := NewSnowflakeGenerator(nodeId)
+	if err != nil {
+		log.Fatalf("Failed to initialize order id generator: %v", err)
 	}
+	log.Printf("[x] Generating order ids with node id %d", nodeId)
 
-	// seed table with customer and product
-	seedTables(dbStore)
+	svc := NewOrderManagementService(dbStore, serverConfig, ids)
+	outbox := NewOutboxRelay(dbStore, rabbitmqService)
 
-	svc := NewOrderManagementService(dbStore)
+	// Stop on SIGTERM from the container runtime or Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	//Start API Server
-	server := NewAPIServer(serverConfig, rabbitmqService, svc)
-	server.Run()
+	server := NewAPIServer(serverConfig, rabbitmqService, svc, outbox)
+	if err := server.Run(ctx); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+
+	// The message broker connection is closed by the deferred Close
+	if err := dbStore.Close(); err != nil {
+		log.Printf("Failed to close the database: %v", err)
+	}
 }
 
-func seedTables(dbStore *PostgresStore) {
-	product := NewProduct("Iphone", 199)
+func initStorage(dbConfig *DbConfig) Storage {
+	switch dbConfig.StorageType {
+	case storageMemory:
+		log.Printf("[x] Using in-memory storage, data will not be persisted")
+		return NewMemoryStore()
+
+	case "", storagePostgres:
+		// Initialize Postgres Client Service
+		dbStore, err := NewPostgresStore(dbConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		log.Printf("[x] Database connected")
+
+		// Replicas starting together wait for each other, the first applies the migrations
+		migrator, err := NewMigrator(dbStore.db)
+		if err != nil {
+			log.Fatalf("Failed to load migrations: %v", err)
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		return dbStore
+
+	default:
+		log.Fatalf("Unknown storage type: %s", dbConfig.StorageType)
+		return nil
+	}
+}
 
-	if err := dbStore.CreateProduct(product); err != nil && !strings.Contains(err.Error(), "duplicate key value") {
+func seedTables(ctx context.Context, dbStore Storage) {
+	products, err := dbStore.ListProducts(ctx, ProductFilter{IncludeDeleted: true, Limit: 1})
+	if err != nil {
 		log.Fatalf("Failed to seed database: %v", err)
 	}
 
-	customer := NewCustomer("Luke Skywalker", "mail@naboo.com")
+	if len(products) == 0 {
+		product := NewProduct("Iphone", common.MustParseMoney("199.00", common.DefaultCurrency), nil)
+		if err := dbStore.CreateProduct(ctx, product); err != nil {
+			log.Fatalf("Failed to seed database: %v", err)
+		}
+
+		productId, _ := strconv.Atoi(product.ProductId)
+		if _, err := dbStore.SetInventory(ctx, productId, 1000); err != nil {
+			log.Fatalf("Failed to seed database: %v", err)
+		}
+	}
 
-	if err := dbStore.CreateCustomer(customer); err != nil && !strings.Contains(err.Error(), "duplicate key value") {
+	customers, err := dbStore.ListCustomers(ctx, CustomerFilter{IncludeDeleted: true, Limit: 1})
+	if err != nil {
 		log.Fatalf("Failed to seed database: %v", err)
 	}
+
+	if len(customers) == 0 {
+		if err := dbStore.CreateCustomer(ctx, NewCustomer("Luke Skywalker", "mail@naboo.com")); err != nil {
+			log.Fatalf("Failed to seed database: %v", err)
+		}
+	}
 }
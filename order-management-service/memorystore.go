@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// MemoryStore is a thread safe in-memory Storage with the same semantics as
+// PostgresStore. It is meant for tests and for running the service locally
+// without a database. Data is lost when the process exits.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	customers      map[int]*Customer
+	products       map[int]*Product
+	orders         map[OrderID]*Order
+	inventory      map[int]*Inventory
+	reservations   map[OrderID][]*memoryReservation
+	outbox         []*memoryOutboxMessage
+	idempotency    map[string]*IdempotencyKey
+	exchangeRates  []*ExchangeRate
+	nextCustomerID int
+	nextProductID  int
+	nextOutboxID   int64
+}
+
+type memoryOutboxMessage struct {
+	message       OutboxMessage
+	nextAttemptAt time.Time
+	lockedUntil   time.Time
+	published     bool
+	lastError     string
+}
+
+type memoryReservation struct {
+	productId int
+	quantity  int64
+	status    string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		customers:      make(map[int]*Customer),
+		products:       make(map[int]*Product),
+		orders:         make(map[OrderID]*Order),
+		inventory:      make(map[int]*Inventory),
+		reservations:   make(map[OrderID][]*memoryReservation),
+		idempotency:    make(map[string]*IdempotencyKey),
+		nextCustomerID: 1,
+		nextProductID:  1,
+		nextOutboxID:   1,
+	}
+}
+
+// Close does nothing, the data is kept until the process exits
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) CreateOrder(ctx context.Context, order *Order, message *OutboxMessage, idempotencyKey *IdempotencyKey) error {
+	id := order.ID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[id]; ok {
+		return fmt.Errorf("duplicate key value: order id %s already exists", order.ID)
+	}
+
+	customerId, err := strconv.Atoi(order.CustomerId)
+	if err != nil || s.customers[customerId] == nil {
+		return fmt.Errorf("customer id %s violates foreign key constraint", order.CustomerId)
+	}
+
+	// Check every line before touching stock so a failed order changes nothing
+	quantities := make(map[int]int64, len(order.Items))
+	for _, item := range order.Items {
+		productId, err := strconv.Atoi(item.ProductId)
+		if err != nil || s.products[productId] == nil {
+			return fmt.Errorf("product id %s violates foreign key constraint", item.ProductId)
+		}
+		quantities[productId] += item.Quantity
+	}
+
+	for productId, quantity := range quantities {
+		// Products created before stock was tracked have no inventory
+		inventory := s.inventory[productId]
+		if inventory == nil {
+			delete(quantities, productId)
+			continue
+		}
+		if inventory.OnHand-inventory.Reserved < quantity {
+			return fmt.Errorf("product id %d: %w", productId, ErrInsufficientStock)
+		}
+	}
+
+	if idempotencyKey != nil {
+		if existing, ok := s.idempotency[idempotencyKey.Key]; ok && !idempotencyKeyExpired(existing) {
+			return ErrIdempotencyKeyExists
+		}
+		stored := *idempotencyKey
+		s.idempotency[idempotencyKey.Key] = &stored
+	}
+
+	for productId, quantity := range quantities {
+		s.inventory[productId].Reserved += quantity
+		s.reservations[id] = append(s.reservations[id], &memoryReservation{
+			productId: productId,
+			quantity:  quantity,
+			status:    reservationReserved,
+		})
+	}
+
+	s.orders[id] = copyOrder(order)
+	s.addOutboxMessage(message)
+
+	return nil
+}
+
+func (s *MemoryStore) CreateProduct(ctx context.Context, product *Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextProductID
+	s.nextProductID++
+
+	product.ProductId = strconv.Itoa(id)
+	s.products[id] = copyProduct(product)
+	s.inventory[id] = &Inventory{ProductId: product.ProductId}
+
+	return nil
+}
+
+func (s *MemoryStore) CreateCustomer(ctx context.Context, customer *Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emailTaken(customer.Email, "") {
+		return ErrEmailTaken
+	}
+
+	id := s.nextCustomerID
+	s.nextCustomerID++
+
+	customer.CustomerId = strconv.Itoa(id)
+	stored := *customer
+	s.customers[id] = &stored
+
+	return nil
+}
+
+func (s *MemoryStore) GetOrderByID(ctx context.Context, id OrderID) (*Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order id %s %w", id, ErrNotFound)
+	}
+
+	return copyOrder(order), nil
+}
+
+func (s *MemoryStore) GetProductByID(ctx context.Context, id int) (*Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	product, ok := s.products[id]
+	if !ok {
+		return nil, fmt.Errorf("product id %d %w", id, ErrNotFound)
+	}
+
+	return copyProduct(product), nil
+}
+
+func (s *MemoryStore) GetCustomerByID(ctx context.Context, id int) (*Customer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	customer, ok := s.customers[id]
+	if !ok {
+		return nil, fmt.Errorf("customer id %d %w", id, ErrNotFound)
+	}
+
+	result := *customer
+	return &result, nil
+}
+
+func (s *MemoryStore) ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error) {
+	sortValue := func(order *Order) time.Time {
+		if filter.SortBy == SortByUpdatedAt {
+			return order.UpdatedAt
+		}
+		return order.CreatedAt
+	}
+
+	if filter.SortBy != SortByCreatedAt && filter.SortBy != SortByUpdatedAt {
+		return nil, fmt.Errorf("invalid sort key %s", filter.SortBy)
+	}
+
+	// less orders by (sort value, id) in the requested direction
+	less := func(a, b *Order) bool {
+		va, vb := sortValue(a), sortValue(b)
+		if !va.Equal(vb) {
+			return va.Before(vb) != filter.Descending
+		}
+		if a.ID == b.ID {
+			return false
+		}
+		return (a.ID < b.ID) != filter.Descending
+	}
+
+	var after *Order
+	if filter.After != nil {
+		after = &Order{ID: filter.After.ID, CreatedAt: filter.After.SortValue, UpdatedAt: filter.After.SortValue}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []*Order{}
+	for _, order := range s.orders {
+		if filter.CustomerId != "" && order.CustomerId != filter.CustomerId {
+			continue
+		}
+		if filter.ProductId != "" && !hasProduct(order, filter.ProductId) {
+			continue
+		}
+		if filter.Status != "" && order.Status != filter.Status {
+			continue
+		}
+		if filter.CreatedFrom != nil && order.CreatedAt.Before(*filter.CreatedFrom) {
+			continue
+		}
+		if filter.CreatedTo != nil && !order.CreatedAt.Before(*filter.CreatedTo) {
+			continue
+		}
+		if after != nil && !less(after, order) {
+			continue
+		}
+		orders = append(orders, order)
+	}
+
+	sort.Slice(orders, func(i, j int) bool { return less(orders[i], orders[j]) })
+
+	if filter.Limit > 0 && len(orders) > filter.Limit {
+		orders = orders[:filter.Limit]
+	}
+	for i, order := range orders {
+		orders[i] = copyOrder(order)
+	}
+
+	return orders, nil
+}
+
+func (s *MemoryStore) ListProducts(ctx context.Context, filter ProductFilter) ([]*Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := []*Product{}
+	for _, id := range sortedKeys(s.products) {
+		product := s.products[id]
+		if id <= filter.AfterID || (!filter.IncludeDeleted && product.DeletedAt != nil) {
+			continue
+		}
+		if filter.Limit > 0 && len(products) == filter.Limit {
+			break
+		}
+		products = append(products, copyProduct(product))
+	}
+
+	return products, nil
+}
+
+func (s *MemoryStore) ListCustomers(ctx context.Context, filter CustomerFilter) ([]*Customer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	customers := []*Customer{}
+	for _, id := range sortedKeys(s.customers) {
+		customer := s.customers[id]
+		if id <= filter.AfterID || (!filter.IncludeDeleted && customer.DeletedAt != nil) {
+			continue
+		}
+		if filter.Limit > 0 && len(customers) == filter.Limit {
+			break
+		}
+		result := *customer
+		customers = append(customers, &result)
+	}
+
+	return customers, nil
+}
+
+func (s *MemoryStore) UpdateProduct(ctx context.Context, product *Product) error {
+	id, _ := strconv.Atoi(product.ProductId)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.products[id]
+	if !ok || stored.DeletedAt != nil {
+		return fmt.Errorf("product id %s %w", product.ProductId, ErrNotFound)
+	}
+
+	stored.Name = product.Name
+	stored.Price = product.Price
+	stored.Prices = append([]common.Money(nil), product.Prices...)
+	return nil
+}
+
+func (s *MemoryStore) DeleteProduct(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	product, ok := s.products[id]
+	if !ok || product.DeletedAt != nil {
+		return fmt.Errorf("product id %d %w", id, ErrNotFound)
+	}
+
+	now := time.Now().UTC()
+	product.DeletedAt = &now
+	return nil
+}
+
+func (s *MemoryStore) UpdateCustomer(ctx context.Context, customer *Customer) error {
+	id, _ := strconv.Atoi(customer.CustomerId)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.customers[id]
+	if !ok || stored.DeletedAt != nil {
+		return fmt.Errorf("customer id %s %w", customer.CustomerId, ErrNotFound)
+	}
+
+	if s.emailTaken(customer.Email, customer.CustomerId) {
+		return ErrEmailTaken
+	}
+
+	stored.Name = customer.Name
+	stored.Email = customer.Email
+	return nil
+}
+
+func (s *MemoryStore) DeleteCustomer(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	customer, ok := s.customers[id]
+	if !ok || customer.DeletedAt != nil {
+		return fmt.Errorf("customer id %d %w", id, ErrNotFound)
+	}
+
+	now := time.Now().UTC()
+	customer.DeletedAt = &now
+	return nil
+}
+
+func (s *MemoryStore) UpdateOrderStatus(ctx context.Context, orderId OrderID, currentStatus, status string, message *OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderId]
+	if !ok || order.Status != currentStatus {
+		return fmt.Errorf("%w: order %s is no longer %s", ErrOrderStatusChanged, orderId, currentStatus)
+	}
+
+	order.Status = status
+	order.UpdatedAt = time.Now().UTC()
+
+	switch status {
+	case OrderCanceled:
+		s.settleInventory(orderId, reservationReleased)
+	case OrderFulfilled, OrderConfirmed:
+		s.settleInventory(orderId, reservationCommitted)
+	}
+
+	if message != nil {
+		s.addOutboxMessage(message)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetInventory(ctx context.Context, productId int) (*Inventory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getInventory(productId)
+}
+
+func (s *MemoryStore) SetInventory(ctx context.Context, productId int, onHand int64) (*Inventory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.products[productId]; !ok {
+		return nil, fmt.Errorf("product id %d violates foreign key constraint", productId)
+	}
+
+	inventory, ok := s.inventory[productId]
+	if !ok {
+		inventory = &Inventory{ProductId: strconv.Itoa(productId)}
+		s.inventory[productId] = inventory
+	}
+
+	if onHand < inventory.Reserved {
+		return nil, fmt.Errorf("stock on hand cannot be lower than the reserved quantity")
+	}
+	inventory.OnHand = onHand
+
+	return s.getInventory(productId)
+}
+
+func (s *MemoryStore) CreateExchangeRate(ctx context.Context, rate *ExchangeRate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *rate
+	for i, existing := range s.exchangeRates {
+		if existing.BaseCurrency == rate.BaseCurrency && existing.QuoteCurrency == rate.QuoteCurrency &&
+			existing.EffectiveFrom.Equal(rate.EffectiveFrom) {
+			s.exchangeRates[i] = &stored
+			return nil
+		}
+	}
+
+	s.exchangeRates = append(s.exchangeRates, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetExchangeRate(ctx context.Context, baseCurrency, quoteCurrency string, at time.Time) (*ExchangeRate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var latest *ExchangeRate
+	for _, rate := range s.exchangeRates {
+		if rate.BaseCurrency != baseCurrency || rate.QuoteCurrency != quoteCurrency || rate.EffectiveFrom.After(at) {
+			continue
+		}
+		if latest == nil || rate.EffectiveFrom.After(latest.EffectiveFrom) {
+			latest = rate
+		}
+	}
+
+	if latest == nil {
+		return nil, fmt.Errorf("exchange rate from %s to %s %w", baseCurrency, quoteCurrency, ErrNotFound)
+	}
+
+	result := *latest
+	return &result, nil
+}
+
+func (s *MemoryStore) GetIdempotencyKey(ctx context.Context, key string) (*IdempotencyKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.idempotency[key]
+	if !ok || idempotencyKeyExpired(stored) {
+		return nil, fmt.Errorf("idempotency key %s %w", key, ErrNotFound)
+	}
+
+	result := *stored
+	return &result, nil
+}
+
+func idempotencyKeyExpired(key *IdempotencyKey) bool {
+	return key.CreatedAt.Before(time.Now().UTC().Add(-idempotencyKeyTTL))
+}
+
+func (s *MemoryStore) CreateOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addOutboxMessage(message)
+	return nil
+}
+
+func (s *MemoryStore) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := []*OutboxMessage{}
+	for _, entry := range s.outbox {
+		if len(messages) == limit {
+			break
+		}
+		if entry.published || entry.nextAttemptAt.After(now) || entry.lockedUntil.After(now) {
+			continue
+		}
+
+		entry.lockedUntil = now.Add(lease)
+		message := entry.message
+		messages = append(messages, &message)
+	}
+
+	return messages, nil
+}
+
+func (s *MemoryStore) MarkOutboxMessagePublished(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.outboxMessage(id)
+	if entry == nil {
+		return fmt.Errorf("outbox message %d %w", id, ErrNotFound)
+	}
+
+	entry.published = true
+	entry.lockedUntil = time.Time{}
+	return nil
+}
+
+func (s *MemoryStore) MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, nextAttempt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.outboxMessage(id)
+	if entry == nil {
+		return fmt.Errorf("outbox message %d %w", id, ErrNotFound)
+	}
+
+	entry.message.Attempts++
+	entry.lastError = reason
+	entry.nextAttemptAt = nextAttempt
+	entry.lockedUntil = time.Time{}
+	return nil
+}
+
+// addOutboxMessage must be called with the lock held
+func (s *MemoryStore) addOutboxMessage(message *OutboxMessage) {
+	message.ID = s.nextOutboxID
+	s.nextOutboxID++
+	s.outbox = append(s.outbox, &memoryOutboxMessage{
+		message:       *message,
+		nextAttemptAt: message.CreatedAt,
+	})
+}
+
+// outboxMessage must be called with the lock held
+func (s *MemoryStore) outboxMessage(id int64) *memoryOutboxMessage {
+	for _, entry := range s.outbox {
+		if entry.message.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// getInventory must be called with the lock held
+func (s *MemoryStore) getInventory(productId int) (*Inventory, error) {
+	if _, ok := s.products[productId]; !ok {
+		return nil, fmt.Errorf("product id %d %w", productId, ErrNotFound)
+	}
+
+	result := Inventory{ProductId: strconv.Itoa(productId), Untracked: true}
+	if inventory, ok := s.inventory[productId]; ok {
+		result = *inventory
+	}
+	result.Available = result.OnHand - result.Reserved
+
+	return &result, nil
+}
+
+// settleInventory must be called with the lock held
+func (s *MemoryStore) settleInventory(orderId OrderID, status string) {
+	for _, reservation := range s.reservations[orderId] {
+		if reservation.status != reservationReserved {
+			continue
+		}
+
+		inventory := s.inventory[reservation.productId]
+		inventory.Reserved -= reservation.quantity
+		if status == reservationCommitted {
+			inventory.OnHand -= reservation.quantity
+		}
+		reservation.status = status
+	}
+}
+
+// emailTaken must be called with the lock held
+func (s *MemoryStore) emailTaken(email, exceptId string) bool {
+	for _, customer := range s.customers {
+		if customer.DeletedAt == nil && customer.CustomerId != exceptId && strings.EqualFold(customer.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasProduct(order *Order, productId string) bool {
+	for _, item := range order.Items {
+		if item.ProductId == productId {
+			return true
+		}
+	}
+	return false
+}
+
+func copyProduct(product *Product) *Product {
+	result := *product
+	result.Prices = append([]common.Money(nil), product.Prices...)
+	return &result
+}
+
+func copyOrder(order *Order) *Order {
+	result := *order
+	result.Items = append([]OrderItem{}, order.Items...)
+	return &result
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
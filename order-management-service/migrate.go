@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// Migrations are named <version>_<name>.up.sql and <version>_<name>.down.sql
+// and are applied in the order of their version
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the postgres advisory lock held while migrating, so replicas
+// starting at the same time apply every migration once
+const migrationLockID = 4_817_302_655
+
+// NewMigrator returns the migrator of the order management schema, recorded in schema_migrations
+func NewMigrator(db *sql.DB) (*common.Migrator, error) {
+	return common.NewMigrator(db, migrationFiles, "migrations", "schema_migrations", migrationLockID)
+}
+
+const migrateUsage = `Usage:
+    oms migrate up              apply the pending migrations
+    oms migrate down [steps]    revert the last applied migrations, default 1
+    oms migrate status          list the migrations and when they were applied`
+
+// runMigrate runs the migrate command against the database configured in the environment
+func runMigrate(ctx context.Context, dbConfig *DbConfig, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing migrate command\n%s", migrateUsage)
+	}
+	if dbConfig.StorageType != "" && dbConfig.StorageType != storagePostgres {
+		return fmt.Errorf("migrations only apply to postgres storage, %s is %s", storageTypeStr, dbConfig.StorageType)
+	}
+
+	steps := 1
+	switch {
+	case args[0] == "down" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of steps %s", args[1])
+		}
+		steps = n
+	case len(args) > 1:
+		return fmt.Errorf("unexpected arguments %v\n%s", args[1:], migrateUsage)
+	}
+
+	dbStore, err := NewPostgresStore(dbConfig)
+	if err != nil {
+		return err
+	}
+	defer dbStore.Close()
+
+	migrator, err := NewMigrator(dbStore.db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := migrator.Up(ctx)
+		fmt.Fprintf(out, "Applied %d migrations\n", n)
+		return err
+
+	case "down":
+		n, err := migrator.Down(ctx, steps)
+		fmt.Fprintf(out, "Reverted %d migrations\n", n)
+		return err
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("unknown migrate command %s\n%s", args[0], migrateUsage)
+	}
+}
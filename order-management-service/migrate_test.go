@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	// Every embedded migration has a valid name and both an up and a down file
+	if _, err := NewMigrator(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunMigrateArguments(t *testing.T) {
+	tests := []struct {
+		storage string
+		args    []string
+	}{
+		{args: nil},
+		{args: []string{"down", "0"}},
+		{args: []string{"down", "two"}},
+		{args: []string{"up", "1"}},
+		{storage: storageMemory, args: []string{"up"}},
+	}
+
+	for _, tt := range tests {
+		// Invalid arguments are rejected before connecting to the database
+		dbConfig := &DbConfig{StorageType: tt.storage}
+		if err := runMigrate(context.Background(), dbConfig, tt.args, io.Discard); err == nil {
+			t.Errorf("runMigrate(%q) with %q storage succeeded", tt.args, tt.storage)
+		}
+	}
+}
+
+func TestMigratorPostgres(t *testing.T) {
+	if os.Getenv(dbHostStr) == "" {
+		t.Skip(dbHostStr + " is not set")
+	}
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+
+	migrator, err := NewMigrator(store.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Applied migrations are skipped
+	if n, err := migrator.Up(ctx); err != nil || n != 0 {
+		t.Fatalf("Up() of a migrated database = %d, %v, want 0", n, err)
+	}
+
+	if n, err := migrator.Down(ctx, 1); err != nil || n != 1 {
+		t.Fatalf("Down(1) = %d, %v, want 1", n, err)
+	}
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range statuses {
+		if pending := status.AppliedAt == nil; pending != (i == len(statuses)-1) {
+			t.Errorf("status after Down(1) of migration %d = %+v, want only the last pending", status.Version, status)
+		}
+	}
+
+	if n, err := migrator.Up(ctx); err != nil || n != 1 {
+		t.Fatalf("Up() after Down(1) = %d, %v, want 1", n, err)
+	}
+}
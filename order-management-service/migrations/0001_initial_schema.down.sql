@@ -0,0 +1,8 @@
+drop table if exists idempotency_keys;
+drop table if exists outbox;
+drop table if exists inventory_reservations;
+drop table if exists inventory;
+drop table if exists order_items;
+drop table if exists orders;
+drop table if exists products;
+drop table if exists customers;
@@ -0,0 +1,115 @@
+-- Databases created before migrations were introduced already have part of this
+-- schema, so every statement can run against them.
+
+create table if not exists customers (
+	customer_id serial primary key,
+	name varchar(100) NOT NULL,
+	email varchar(100),
+	deleted_at timestamp
+);
+
+alter table customers add column if not exists deleted_at timestamp;
+create unique index if not exists customers_email_key on customers (lower(email)) where deleted_at is null;
+select setval(pg_get_serial_sequence('customers', 'customer_id'), coalesce(max(customer_id), 0) + 1, false) from customers;
+
+create table if not exists products (
+	product_id serial primary key,
+	name varchar(100) NOT NULL,
+	price DECIMAL(10, 2) NOT NULL,
+	deleted_at timestamp
+);
+
+alter table products add column if not exists deleted_at timestamp;
+
+-- Rows inserted with explicit ids do not advance the sequence
+select setval(pg_get_serial_sequence('products', 'product_id'), coalesce(max(product_id), 0) + 1, false) from products;
+
+create table if not exists orders (
+	id bigint primary key,
+	customer_id INT NOT NULL,
+	total_price DECIMAL(10,2) NOT NULL,
+	status varchar(50) NOT NULL,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	FOREIGN KEY (customer_id) REFERENCES customers(customer_id)
+);
+
+create table if not exists order_items (
+	order_id BIGINT NOT NULL,
+	line_no INT NOT NULL,
+	product_id INT NOT NULL,
+	quantity INT NOT NULL,
+	unit_price DECIMAL(10,2) NOT NULL,
+	subtotal DECIMAL(10,2) NOT NULL,
+	PRIMARY KEY (order_id, line_no),
+	FOREIGN KEY (order_id) REFERENCES orders(id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id)
+);
+
+-- Orders created before line items were introduced carried a single product.
+-- Move it into order_items so every order is read the same way.
+do $$
+begin
+	if exists (select 1 from information_schema.columns where table_name = 'orders' and column_name = 'product_id') then
+		insert into order_items (order_id, line_no, product_id, quantity, unit_price, subtotal)
+		select id, 1, product_id, quantity, case when quantity = 0 then 0 else total_price / quantity end, total_price from orders;
+		alter table orders drop column product_id, drop column quantity;
+	end if;
+end $$;
+
+create table if not exists inventory (
+	product_id INT primary key,
+	on_hand INT NOT NULL DEFAULT 0,
+	reserved INT NOT NULL DEFAULT 0,
+	CHECK (reserved >= 0 AND reserved <= on_hand),
+	FOREIGN KEY (product_id) REFERENCES products(product_id)
+);
+
+create table if not exists inventory_reservations (
+	order_id BIGINT NOT NULL,
+	product_id INT NOT NULL,
+	quantity INT NOT NULL,
+	status varchar(20) NOT NULL,
+	PRIMARY KEY (order_id, product_id),
+	FOREIGN KEY (order_id) REFERENCES orders(id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id)
+);
+
+create table if not exists outbox (
+	id bigserial primary key,
+	queue varchar(100) NOT NULL,
+	reply_to varchar(100) NOT NULL,
+	correlation_id varchar(100) NOT NULL,
+	payload bytea NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error text,
+	created_at timestamp NOT NULL,
+	next_attempt_at timestamp NOT NULL,
+	locked_until timestamp,
+	published_at timestamp
+);
+
+create index if not exists outbox_pending_idx on outbox (next_attempt_at) where published_at is null;
+
+create table if not exists idempotency_keys (
+	key varchar(255) primary key,
+	request_hash varchar(64) NOT NULL,
+	status_code INT NOT NULL,
+	response bytea NOT NULL,
+	created_at timestamp NOT NULL
+);
+
+-- Order ids used to be random serial integers, they are now snowflake ids
+do $$
+begin
+	if exists (select 1 from information_schema.columns where table_name = 'orders' and column_name = 'id' and data_type = 'integer') then
+		alter table orders alter column id drop default, alter column id type bigint;
+		alter table order_items alter column order_id type bigint;
+		alter table inventory_reservations alter column order_id type bigint;
+	end if;
+end $$;
+
+create index if not exists orders_created_at_idx on orders (created_at, id);
+create index if not exists orders_updated_at_idx on orders (updated_at, id);
+create index if not exists orders_customer_id_idx on orders (customer_id);
+create index if not exists order_items_product_id_idx on order_items (product_id);
@@ -0,0 +1,2 @@
+alter table orders drop column currency;
+alter table products drop column currency;
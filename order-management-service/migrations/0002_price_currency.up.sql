@@ -0,0 +1,3 @@
+-- Prices are stored in the major unit of their currency, order items use the currency of their order
+alter table products add column currency varchar(3) NOT NULL DEFAULT 'USD';
+alter table orders add column currency varchar(3) NOT NULL DEFAULT 'USD';
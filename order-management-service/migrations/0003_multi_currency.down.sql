@@ -0,0 +1,2 @@
+drop table exchange_rates;
+drop table product_prices;
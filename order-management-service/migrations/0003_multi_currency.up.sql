@@ -0,0 +1,18 @@
+-- Prices of a product in currencies other than its base currency
+create table product_prices (
+	product_id INT NOT NULL,
+	currency varchar(3) NOT NULL,
+	price DECIMAL(10, 2) NOT NULL,
+	PRIMARY KEY (product_id, currency),
+	FOREIGN KEY (product_id) REFERENCES products(product_id)
+);
+
+-- Price of one unit of the base currency in the quote currency, in effect from effective_from
+-- until the next rate of the pair
+create table exchange_rates (
+	base_currency varchar(3) NOT NULL,
+	quote_currency varchar(3) NOT NULL,
+	rate DECIMAL(20, 10) NOT NULL,
+	effective_from timestamp NOT NULL,
+	PRIMARY KEY (base_currency, quote_currency, effective_from)
+);
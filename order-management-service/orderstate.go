@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidTransition is returned when an order cannot move to the requested status
+	ErrInvalidTransition = errors.New("invalid order status transition")
+
+	// ErrOrderStatusChanged is returned by storage when the status of an order changed
+	// after it was read, so the update was not applied
+	ErrOrderStatusChanged = errors.New("order status changed")
+)
+
+// maxPaymentResponseAttempts is the number of times a payment response is applied to
+// an order whose status keeps changing concurrently before it is retried later
+const maxPaymentResponseAttempts = 3
+
+// orderTransitions lists the statuses an order can move to from each status.
+// Pending orders wait for their payment to be authorized. Authorized orders are
+// captured while Capturing, once fulfilled, or voided while Voiding, once canceled.
+// Capturing orders cannot be canceled, a capture that fails voids the hold instead.
+// Confirmed orders were paid in a single step by payment services that predate
+// authorizations. Paid orders are refunded while Refunding, once canceled.
+// Canceled and Refunded are final.
+var orderTransitions = map[string][]string{
+	OrderPending:    {OrderAuthorized, OrderConfirmed, OrderCanceled},
+	OrderAuthorized: {OrderCapturing, OrderVoiding},
+	OrderCapturing:  {OrderFulfilled, OrderVoiding},
+	OrderVoiding:    {OrderCanceled},
+	OrderFulfilled:  {OrderRefunding},
+	OrderConfirmed:  {OrderRefunding},
+	OrderRefunding:  {OrderRefunded},
+	OrderCanceled:   {},
+	OrderRefunded:   {},
+}
+
+func isValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// canTransition reports whether an order in status from can move to status to
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func checkTransition(orderId OrderID, from, to string) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("%w: order %s cannot move from %s to %s", ErrInvalidTransition, orderId, from, to)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{OrderPending, OrderAuthorized, true},
+		{OrderPending, OrderConfirmed, true},
+		{OrderPending, OrderCanceled, true},
+		{OrderPending, OrderCapturing, false},
+		{OrderPending, OrderFulfilled, false},
+		{OrderPending, OrderVoiding, false},
+
+		{OrderAuthorized, OrderCapturing, true},
+		{OrderAuthorized, OrderVoiding, true},
+		{OrderAuthorized, OrderCanceled, false},
+		{OrderAuthorized, OrderFulfilled, false},
+
+		// Capturing orders cannot be canceled, a failed capture voids the hold
+		{OrderCapturing, OrderFulfilled, true},
+		{OrderCapturing, OrderVoiding, true},
+		{OrderCapturing, OrderCanceled, false},
+
+		{OrderVoiding, OrderCanceled, true},
+		{OrderVoiding, OrderAuthorized, false},
+
+		{OrderFulfilled, OrderRefunding, true},
+		{OrderFulfilled, OrderCanceled, false},
+		{OrderConfirmed, OrderRefunding, true},
+		{OrderConfirmed, OrderCanceled, false},
+		{OrderRefunding, OrderRefunded, true},
+		{OrderRefunding, OrderFulfilled, false},
+
+		{OrderCanceled, OrderPending, false},
+		{OrderCanceled, OrderAuthorized, false},
+		{OrderRefunded, OrderRefunding, false},
+
+		{OrderAuthorized, OrderAuthorized, false},
+		{"Shipped", OrderCanceled, false},
+		{OrderPending, "Shipped", false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestOrderTransitionsAreKnown(t *testing.T) {
+	// Every status is known and every status moves to known statuses
+	for from, next := range orderTransitions {
+		for _, to := range next {
+			if !isValidOrderStatus(to) {
+				t.Errorf("%s moves to unknown status %s", from, to)
+			}
+		}
+	}
+
+	for _, status := range []string{OrderCanceled, OrderRefunded} {
+		if next := orderTransitions[status]; len(next) != 0 {
+			t.Errorf("%s is final but moves to %v", status, next)
+		}
+	}
+}
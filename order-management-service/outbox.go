@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+const (
+	outboxPollInterval = time.Second
+	outboxBatchSize    = 100
+
+	// outboxLease is how long a claimed message is hidden from other relays,
+	// it only matters if a relay dies while publishing
+	outboxLease = 30 * time.Second
+
+	outboxRetryBaseDelay = time.Second
+	outboxRetryMaxDelay  = time.Minute
+)
+
+// OutboxRelay publishes messages saved in the outbox table to the message broker.
+// A message is only marked as published after the broker accepted it, so delivery
+// is at-least-once: consumers may see a message again after a relay crash.
+type OutboxRelay struct {
+	repo  Storage
+	mqSvc common.MqSvc
+	wake  chan struct{}
+}
+
+func NewOutboxRelay(repo Storage, mqSvc common.MqSvc) *OutboxRelay {
+	return &OutboxRelay{
+		repo:  repo,
+		mqSvc: mqSvc,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay up without waiting for the next poll
+func (r *OutboxRelay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls the outbox and publishes pending messages until ctx is canceled
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.publishPending(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush publishes the pending messages once, it is called on shutdown after
+// Run returned so that orders created last do not wait for the next start
+func (r *OutboxRelay) Flush(ctx context.Context) {
+	r.publishPending(ctx)
+}
+
+func (r *OutboxRelay) publishPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := r.repo.ClaimOutboxMessages(ctx, outboxBatchSize, outboxLease)
+		if err != nil {
+			log.Printf("Failed to read outbox messages: %v", err)
+			return
+		}
+
+		for _, message := range messages {
+			// Claimed messages that are not published become available again when the lease expires
+			if ctx.Err() != nil {
+				return
+			}
+			r.publish(ctx, message)
+		}
+
+		if len(messages) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+func (r *OutboxRelay) publish(ctx context.Context, message *OutboxMessage) {
+	// The outcome is recorded even when ctx was canceled during the publish
+	recordCtx := context.WithoutCancel(ctx)
+
+	err := r.mqSvc.Publish(ctx, message.Queue, message.Payload, message.ReplyTo, message.CorrelationId)
+	if err != nil {
+		delay := outboxRetryDelay(message.Attempts + 1)
+		if ctx.Err() != nil {
+			// Interrupted by shutdown, make the message available to Flush right away
+			delay = 0
+		}
+		log.Printf("[%s] Failed to publish outbox message %d attempt %d, retrying in %v: %v",
+			message.CorrelationId, message.ID, message.Attempts+1, delay, err)
+
+		if err := r.repo.MarkOutboxMessageFailed(recordCtx, message.ID, err.Error(), time.Now().UTC().Add(delay)); err != nil {
+			log.Printf("[%s] Failed to update outbox message %d: %v", message.CorrelationId, message.ID, err)
+		}
+		return
+	}
+
+	if err := r.repo.MarkOutboxMessagePublished(recordCtx, message.ID); err != nil {
+		// The lease expires and the message is published again
+		log.Printf("[%s] Failed to mark outbox message %d as published: %v", message.CorrelationId, message.ID, err)
+		return
+	}
+
+	log.Printf("[%s] outbox message %d published to %s", message.CorrelationId, message.ID, message.Queue)
+}
+
+// outboxRetryDelay doubles the delay with every failed attempt up to outboxRetryMaxDelay
+func outboxRetryDelay(attempt int) time.Duration {
+	delay := outboxRetryBaseDelay
+	for i := 1; i < attempt && delay < outboxRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxRetryMaxDelay)
+}
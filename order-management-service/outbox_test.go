@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: 2 * time.Second},
+		{attempt: 4, want: 8 * time.Second},
+		{attempt: 7, want: time.Minute},
+		{attempt: 100, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := outboxRetryDelay(tt.attempt); got != tt.want {
+			t.Errorf("outboxRetryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -1,102 +1,809 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aayush993/go-order-management/common"
 )
 
 type Service interface {
-	CreateOrder(string, string, int64) (*Order, error)
-	GetOrder(int) (*Order, error)
-	UpdateOrderStatus(string, string) error
+	CreateOrder(context.Context, string, string, []OrderItemRequest, string, *IdempotencyKey) (*Order, error)
+	GetIdempotencyKey(context.Context, string) (*IdempotencyKey, error)
+	GetOrder(context.Context, OrderID) (*Order, error)
+	ListOrders(context.Context, OrderFilter) (*OrderPage, error)
+	UpdateOrderStatus(context.Context, OrderID, common.PaymentResponse, string) error
+	FulfillOrder(context.Context, OrderID, string) (*Order, error)
+	CancelOrder(context.Context, OrderID, string) (*Order, error)
+
+	CreateProduct(context.Context, string, common.Money, []common.Money) (*Product, error)
+	GetProduct(context.Context, int) (*Product, error)
+	ListProducts(context.Context, ProductFilter) (*ProductPage, error)
+	UpdateProduct(context.Context, int, string, common.Money, []common.Money) (*Product, error)
+	DeleteProduct(context.Context, int) error
+	GetInventory(context.Context, int) (*Inventory, error)
+	SetInventory(context.Context, int, int64) (*Inventory, error)
+
+	CreateCustomer(context.Context, string, string) (*Customer, error)
+	GetCustomer(context.Context, int) (*Customer, error)
+	ListCustomers(context.Context, CustomerFilter) (*CustomerPage, error)
+	UpdateCustomer(context.Context, int, string, string) (*Customer, error)
+	DeleteCustomer(context.Context, int) error
+	ListCustomerOrders(context.Context, int, OrderFilter) (*OrderPage, error)
+
+	CreateExchangeRate(context.Context, string, string, string, time.Time) (*ExchangeRate, error)
+	GetExchangeRate(context.Context, string, string, time.Time) (*ExchangeRate, error)
 }
 
 type OrderManagementService struct {
-	repo Storage
+	repo   Storage
+	config *ServerConfig
+	ids    IDGenerator
 }
 
-func NewOrderManagementService(repo Storage) Service {
+func NewOrderManagementService(repo Storage, config *ServerConfig, ids IDGenerator) Service {
 	return &OrderManagementService{
-		repo: repo,
+		repo:   repo,
+		config: config,
+		ids:    ids,
 	}
 }
 
-func (s *OrderManagementService) CreateOrder(customerId, productId string, quantity int64) (*Order, error) {
+// CreateOrder saves the order together with the authorization of its payment in the
+// outbox, the outbox relay publishes the request once the order is committed.
+// When idempotencyKey is set the created order is recorded as its response.
+// The order is priced in currency, DefaultCurrency when it is empty.
+func (s *OrderManagementService) CreateOrder(ctx context.Context, customerId, currency string, itemRequests []OrderItemRequest, requestId string, idempotencyKey *IdempotencyKey) (*Order, error) {
 
 	// Validate customer Id
-	err := validateCustomerInfo(s.repo, customerId)
+	err := validateCustomerInfo(ctx, s.repo, customerId)
 	if err != nil {
 		return nil, err
 	}
-	// Get product price
-	product, err := getProductInformation(s.repo, productId)
+
+	if currency == "" {
+		currency = common.DefaultCurrency
+	}
+	if !common.ValidCurrency(currency) {
+		return nil, fmt.Errorf("%w %q", common.ErrUnknownCurrency, currency)
+	}
+	pricedAt := time.Now().UTC()
+
+	if len(itemRequests) == 0 {
+		return nil, fmt.Errorf("order must contain at least one item")
+	}
+
+	items := make([]OrderItem, 0, len(itemRequests))
+	seen := make(map[string]bool, len(itemRequests))
+	for _, req := range itemRequests {
+		if req.Quantity <= 0 {
+			return nil, fmt.Errorf("invalid quantity %d for product id %s", req.Quantity, req.ProductId)
+		}
+		if seen[req.ProductId] {
+			return nil, fmt.Errorf("duplicate product id %s", req.ProductId)
+		}
+		seen[req.ProductId] = true
+
+		// Get product price
+		product, err := getProductInformation(ctx, s.repo, req.ProductId)
+		if err != nil {
+			return nil, err
+		}
+
+		price, err := s.priceIn(ctx, product, currency, pricedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		item, err := NewOrderItem(product.ProductId, req.Quantity, price)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	id, err := s.ids.NextID()
 	if err != nil {
 		return nil, err
 	}
 
-	order := NewOrder(customerId, productId, quantity, product.Price)
+	order, err := NewOrder(id, customerId, items)
+	if err != nil {
+		return nil, err
+	}
+	if !fitsPriceColumn(order.TotalPrice) {
+		return nil, fmt.Errorf("order total %s is too large", order.TotalPrice)
+	}
 
-	if err := s.repo.CreateOrder(order); err != nil {
+	message, err := s.paymentMessage(order, common.PaymentAuthorize, requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	if idempotencyKey != nil {
+		idempotencyKey.StatusCode = http.StatusCreated
+		if idempotencyKey.Response, err = json.Marshal(order); err != nil {
+			return nil, fmt.Errorf("failed to marshal order: %v", err)
+		}
+	}
+
+	if err := s.repo.CreateOrder(ctx, order, message, idempotencyKey); err != nil {
 		return nil, err
 	}
 
 	return order, nil
 }
 
-func (s *OrderManagementService) GetOrder(id int) (*Order, error) {
+func (s *OrderManagementService) GetIdempotencyKey(ctx context.Context, key string) (*IdempotencyKey, error) {
+	return s.repo.GetIdempotencyKey(ctx, key)
+}
+
+func (s *OrderManagementService) GetOrder(ctx context.Context, id OrderID) (*Order, error) {
 
-	order, err := s.repo.GetOrderByID(id)
+	order, err := s.repo.GetOrderByID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 	return order, nil
 }
 
-func (s *OrderManagementService) UpdateOrderStatus(orderId, paymentStatus string) error {
+func (s *OrderManagementService) ListOrders(ctx context.Context, filter OrderFilter) (*OrderPage, error) {
+
+	if err := validateOrderFilter(&filter); err != nil {
+		return nil, err
+	}
+
+	orders, next, err := listPage(filter.Limit, func(limit int) ([]*Order, error) {
+		query := filter
+		query.Limit = limit
+		return s.repo.ListOrders(ctx, query)
+	}, func(last *Order) (any, error) {
+		return newOrderCursor(last, filter.SortBy, filter.Descending), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrderPage{Orders: orders, NextCursor: next}, nil
+}
+
+// paymentMessage returns the outbox message of a payment request of paymentType for the order
+func (s *OrderManagementService) paymentMessage(order *Order, paymentType, requestId string) (*OutboxMessage, error) {
+	body, err := json.Marshal(common.PaymentRequest{
+		Type:       paymentType,
+		OrderID:    order.ID.String(),
+		CustomerID: order.CustomerId,
+		TotalPrice: order.TotalPrice,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payment request: %v", err)
+	}
+
+	return NewOutboxMessage(s.config.OrdersQueue, s.config.PaymentsStatusQueue, requestId, body), nil
+}
+
+// UpdateOrderStatus applies a payment response to its order. Payments authorized
+// after their order was canceled are voided. A customer can change the order while
+// the response is applied, the response is then applied again to the order as it is now.
+func (s *OrderManagementService) UpdateOrderStatus(ctx context.Context, orderId OrderID, response common.PaymentResponse, requestId string) error {
+	var err error
+	for attempt := 0; attempt < maxPaymentResponseAttempts; attempt++ {
+		err = s.applyPaymentResponse(ctx, orderId, response, requestId)
+		if !errors.Is(err, ErrOrderStatusChanged) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *OrderManagementService) applyPaymentResponse(ctx context.Context, orderId OrderID, response common.PaymentResponse, requestId string) error {
+
+	order, err := s.repo.GetOrderByID(ctx, orderId)
+	if err != nil {
+		return err
+	}
+
+	// Responses without a type answer authorizations
+	paymentType := response.Type
+	if paymentType == "" {
+		paymentType = common.PaymentAuthorize
+	}
 
 	// Get order Status
 	var orderStatus string
-	switch paymentStatus {
-	case common.PaymentSuccessfull:
+	switch paymentType + "/" + response.PaymentStatus {
+	case common.PaymentAuthorize + "/" + common.PaymentAuthorized:
+		switch order.Status {
+		case OrderCanceled:
+			// The order was canceled while its payment was being authorized
+			message, err := s.paymentMessage(order, common.PaymentVoid, requestId)
+			if err != nil {
+				return err
+			}
+			return s.repo.CreateOutboxMessage(ctx, message)
+
+		case OrderCapturing, OrderFulfilled, OrderVoiding, OrderRefunding, OrderRefunded:
+			// An authorization delivered again after the order moved on
+			return nil
+		}
+		orderStatus = OrderAuthorized
+	case common.PaymentAuthorize + "/" + common.PaymentSuccessfull:
 		orderStatus = OrderConfirmed
-	case common.PaymentFailed:
+	case common.PaymentAuthorize + "/" + common.PaymentFailed:
 		orderStatus = OrderCanceled
+	case common.PaymentCapture + "/" + common.PaymentCaptured:
+		orderStatus = OrderFulfilled
+	case common.PaymentCapture + "/" + common.PaymentFailed:
+		switch order.Status {
+		case OrderVoiding, OrderCanceled:
+			// A failed capture delivered again after the hold was voided
+			return nil
+		}
+
+		// The hold may still be in place, it is released before the order is canceled
+		message, err := s.paymentMessage(order, common.PaymentVoid, requestId)
+		if err != nil {
+			return err
+		}
+		return s.transitionOrder(ctx, order, OrderVoiding, message)
+	case common.PaymentVoid + "/" + common.PaymentVoided:
+		orderStatus = OrderCanceled
+	case common.PaymentRefund + "/" + common.PaymentRefunded:
+		orderStatus = OrderRefunded
 	default:
-		return fmt.Errorf("invalid payment status: %v", paymentStatus)
+		// Failed voids and refunds leave money with the wrong party, they are dead-lettered for review
+		return fmt.Errorf("%w: %s of %s", ErrInvalidPaymentStatus, response.PaymentStatus, paymentType)
+	}
 
+	// A payment response delivered again after it was applied
+	if order.Status == orderStatus {
+		return nil
 	}
 
-	err := s.repo.UpdateOrderStatus(orderId, orderStatus)
+	return s.transitionOrder(ctx, order, orderStatus, nil)
+}
+
+// FulfillOrder captures the payment of an authorized order. The order is Capturing
+// until the payment processing service confirms the capture.
+func (s *OrderManagementService) FulfillOrder(ctx context.Context, id OrderID, requestId string) (*Order, error) {
+
+	order, err := s.repo.GetOrderByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.paymentMessage(order, common.PaymentCapture, requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.transitionOrder(ctx, order, OrderCapturing, message); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// CancelOrder cancels a pending order. Authorized orders are Voiding until their
+// hold is released, and paid orders are Refunding until their payment is refunded.
+// Orders waiting for a payment response or in a final status cannot be canceled,
+// Voiding orders are canceled only by their void.
+func (s *OrderManagementService) CancelOrder(ctx context.Context, id OrderID, requestId string) (*Order, error) {
+
+	order, err := s.repo.GetOrderByID(ctx, id)
 	if err != nil {
+		return nil, err
+	}
+
+	var message *OutboxMessage
+	var next string
+	switch order.Status {
+	case OrderPending:
+		next = OrderCanceled
+	case OrderAuthorized:
+		next = OrderVoiding
+		if message, err = s.paymentMessage(order, common.PaymentVoid, requestId); err != nil {
+			return nil, err
+		}
+	case OrderFulfilled, OrderConfirmed:
+		next = OrderRefunding
+		if message, err = s.paymentMessage(order, common.PaymentRefund, requestId); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: order %s cannot be canceled while %s", ErrInvalidTransition, order.ID, order.Status)
+	}
+
+	if err := s.transitionOrder(ctx, order, next, message); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// transitionOrder validates the move against the order state machine and persists it,
+// together with the optional payment request
+func (s *OrderManagementService) transitionOrder(ctx context.Context, order *Order, status string, message *OutboxMessage) error {
+	if err := checkTransition(order.ID, order.Status, status); err != nil {
 		return err
 	}
 
-	return nil
+	if err := s.repo.UpdateOrderStatus(ctx, order.ID, order.Status, status, message); err != nil {
+		return err
+	}
 
+	order.Status = status
+	order.UpdatedAt = time.Now().UTC()
+	return nil
 }
 
-func validateCustomerInfo(repo Storage, custId string) error {
+func validateCustomerInfo(ctx context.Context, repo Storage, custId string) error {
 	customerId, err := strconv.Atoi(custId)
 	if err != nil {
 		return fmt.Errorf("invalid customer id %s", custId)
 	}
 
-	customer, err := repo.GetCustomerByID(customerId)
-	if err != nil || customer == nil {
+	customer, err := repo.GetCustomerByID(ctx, customerId)
+	if err != nil || customer == nil || customer.DeletedAt != nil {
 		return fmt.Errorf("invalid customer id %s", custId)
 	}
 
 	return nil
 }
 
-func getProductInformation(repo Storage, prodId string) (*Product, error) {
+func getProductInformation(ctx context.Context, repo Storage, prodId string) (*Product, error) {
 	productId, err := strconv.Atoi(prodId)
 	if err != nil {
 		return nil, fmt.Errorf("invalid product id %s", prodId)
 	}
 
-	return repo.GetProductByID(productId)
+	product, err := repo.GetProductByID(ctx, productId)
+	if err != nil {
+		return nil, err
+	}
+
+	if product.DeletedAt != nil {
+		return nil, fmt.Errorf("product id %s: %w", prodId, ErrProductRetired)
+	}
+
+	return product, nil
+}
+
+func (s *OrderManagementService) CreateProduct(ctx context.Context, name string, price common.Money, prices []common.Money) (*Product, error) {
+
+	product := NewProduct(name, price, prices)
+	if err := validateProduct(product); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.CreateProduct(ctx, product); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// GetProduct returns the product even if it was deleted so that
+// historical orders referencing it can still be resolved
+func (s *OrderManagementService) GetProduct(ctx context.Context, id int) (*Product, error) {
+	return s.repo.GetProductByID(ctx, id)
+}
+
+func (s *OrderManagementService) ListProducts(ctx context.Context, filter ProductFilter) (*ProductPage, error) {
+
+	var err error
+	if filter.Limit, filter.AfterID, err = idPageBounds(filter.Limit, filter.Cursor); err != nil {
+		return nil, err
+	}
+
+	products, next, err := listPage(filter.Limit, func(limit int) ([]*Product, error) {
+		query := filter
+		query.Limit = limit
+		return s.repo.ListProducts(ctx, query)
+	}, func(last *Product) (any, error) {
+		return idCursor(last.ProductId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProductPage{Products: products, NextCursor: next}, nil
+}
+
+func (s *OrderManagementService) UpdateProduct(ctx context.Context, id int, name string, price common.Money, prices []common.Money) (*Product, error) {
+
+	product, err := s.repo.GetProductByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 
+	if product.DeletedAt != nil {
+		return nil, fmt.Errorf("product id %d: %w", id, ErrProductRetired)
+	}
+
+	product.Name = name
+	product.Price = price
+	product.Prices = prices
+	if err := validateProduct(product); err != nil {
+		return nil, err
+	}
+
+	// Existing orders keep the unit price they were placed with
+	if err := s.repo.UpdateProduct(ctx, product); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// DeleteProduct retires the product. The row is kept so existing orders still resolve.
+func (s *OrderManagementService) DeleteProduct(ctx context.Context, id int) error {
+	return s.repo.DeleteProduct(ctx, id)
+}
+
+// priceIn returns the price of the product in currency. Prices set for the currency
+// take precedence, otherwise the base price is converted with the exchange rate
+// in effect at the given time.
+func (s *OrderManagementService) priceIn(ctx context.Context, product *Product, currency string, at time.Time) (common.Money, error) {
+	if product.Price.Currency == currency {
+		return product.Price, nil
+	}
+	for _, price := range product.Prices {
+		if price.Currency == currency {
+			return price, nil
+		}
+	}
+
+	rate, err := s.repo.GetExchangeRate(ctx, product.Price.Currency, currency, at)
+	if errors.Is(err, ErrNotFound) {
+		return common.Money{}, fmt.Errorf("product id %s has no price in %s: %w from %s", product.ProductId, currency, ErrNoExchangeRate, product.Price.Currency)
+	}
+	if err != nil {
+		return common.Money{}, err
+	}
+
+	r, err := common.ParseRate(rate.Rate)
+	if err != nil {
+		return common.Money{}, err
+	}
+	return product.Price.Convert(currency, r)
+}
+
+// CreateExchangeRate saves a rate taking effect at effectiveFrom, now when it is zero.
+// A rate saved again for the same time replaces the previous one.
+func (s *OrderManagementService) CreateExchangeRate(ctx context.Context, baseCurrency, quoteCurrency, rate string, effectiveFrom time.Time) (*ExchangeRate, error) {
+	if effectiveFrom.IsZero() {
+		effectiveFrom = time.Now()
+	}
+
+	exchangeRate := NewExchangeRate(baseCurrency, quoteCurrency, rate, effectiveFrom)
+	if err := validateExchangeRate(exchangeRate); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.CreateExchangeRate(ctx, exchangeRate); err != nil {
+		return nil, err
+	}
+
+	return exchangeRate, nil
+}
+
+// GetExchangeRate returns the rate of the currency pair in effect at the given time
+func (s *OrderManagementService) GetExchangeRate(ctx context.Context, baseCurrency, quoteCurrency string, at time.Time) (*ExchangeRate, error) {
+	return s.repo.GetExchangeRate(ctx, baseCurrency, quoteCurrency, at.UTC())
+}
+
+func (s *OrderManagementService) GetInventory(ctx context.Context, productId int) (*Inventory, error) {
+	return s.repo.GetInventory(ctx, productId)
+}
+
+func (s *OrderManagementService) SetInventory(ctx context.Context, productId int, onHand int64) (*Inventory, error) {
+
+	if onHand < 0 {
+		return nil, fmt.Errorf("stock on hand cannot be negative")
+	}
+
+	product, err := s.repo.GetProductByID(ctx, productId)
+	if err != nil {
+		return nil, err
+	}
+
+	if product.DeletedAt != nil {
+		return nil, fmt.Errorf("product id %d: %w", productId, ErrProductRetired)
+	}
+
+	return s.repo.SetInventory(ctx, productId, onHand)
+}
+
+func validateProduct(product *Product) error {
+	product.Name = strings.TrimSpace(product.Name)
+	if product.Name == "" {
+		return fmt.Errorf("product name is required")
+	}
+	if len(product.Name) > maxNameLength {
+		return fmt.Errorf("product name must be at most %d characters", maxNameLength)
+	}
+
+	// Prices are parsed exactly, amounts with more decimal places than the currency are rejected when decoding
+	currencies := map[string]bool{}
+	for _, price := range append([]common.Money{product.Price}, product.Prices...) {
+		if price.Amount <= 0 || !fitsPriceColumn(price) {
+			return fmt.Errorf("product price must be greater than 0 and less than %d", maxPriceUnits)
+		}
+		if currencies[price.Currency] {
+			return fmt.Errorf("product has more than one price in %s", price.Currency)
+		}
+		currencies[price.Currency] = true
+	}
+
+	return nil
+}
+
+// validateExchangeRate checks the currencies and that the rate fits the DECIMAL(20, 10) column
+func validateExchangeRate(rate *ExchangeRate) error {
+	for _, currency := range []string{rate.BaseCurrency, rate.QuoteCurrency} {
+		if !common.ValidCurrency(currency) {
+			return fmt.Errorf("%w %q", common.ErrUnknownCurrency, currency)
+		}
+	}
+	if rate.BaseCurrency == rate.QuoteCurrency {
+		return fmt.Errorf("exchange rate currencies must be different")
+	}
+
+	r, err := common.ParseRate(rate.Rate)
+	if err != nil {
+		return err
+	}
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(maxRateDecimals), nil)))
+	if !scaled.IsInt() {
+		return fmt.Errorf("exchange rate must have at most %d decimal places", maxRateDecimals)
+	}
+	if r.Cmp(new(big.Rat).SetInt64(maxRateUnits)) >= 0 {
+		return fmt.Errorf("exchange rate must be less than %d", maxRateUnits)
+	}
+
+	rate.Rate = trimDecimal(rate.Rate)
+	return nil
+}
+
+// trimDecimal removes the trailing zeros of the fraction of a decimal number
+func trimDecimal(s string) string {
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+}
+
+// fitsPriceColumn reports whether an amount can be stored in a DECIMAL(10, 2) column
+func fitsPriceColumn(m common.Money) bool {
+	return m.Amount/m.Scale() < maxPriceUnits && m.Amount/m.Scale() > -maxPriceUnits
+}
+
+// validateOrderFilter checks the list criteria and fills in defaults
+func validateOrderFilter(filter *OrderFilter) error {
+	if filter.CustomerId != "" {
+		if _, err := strconv.Atoi(filter.CustomerId); err != nil {
+			return fmt.Errorf("invalid customer id %s", filter.CustomerId)
+		}
+	}
+
+	if filter.ProductId != "" {
+		if _, err := strconv.Atoi(filter.ProductId); err != nil {
+			return fmt.Errorf("invalid product id %s", filter.ProductId)
+		}
+	}
+
+	if filter.Status != "" && !isValidOrderStatus(filter.Status) {
+		return fmt.Errorf("invalid order status %s", filter.Status)
+	}
+
+	if filter.CreatedFrom != nil && filter.CreatedTo != nil && filter.CreatedFrom.After(*filter.CreatedTo) {
+		return fmt.Errorf("createdFrom must be before createdTo")
+	}
+
+	switch filter.SortBy {
+	case "":
+		filter.SortBy = SortByCreatedAt
+	case SortByCreatedAt, SortByUpdatedAt:
+	default:
+		return fmt.Errorf("invalid sort key %s", filter.SortBy)
+	}
+
+	var err error
+	if filter.Limit, err = pageLimit(filter.Limit); err != nil {
+		return err
+	}
+
+	if filter.Cursor != "" {
+		cursor := new(OrderCursor)
+		if err := decodeCursor(filter.Cursor, cursor); err != nil {
+			return err
+		}
+
+		// A cursor is only meaningful for the ordering it was issued for
+		if cursor.SortBy != filter.SortBy || cursor.Descending != filter.Descending {
+			return fmt.Errorf("cursor does not match requested sort order")
+		}
+		filter.After = cursor
+	}
+
+	return nil
+}
+
+func (s *OrderManagementService) CreateCustomer(ctx context.Context, name, email string) (*Customer, error) {
+
+	customer := NewCustomer(name, email)
+	if err := validateCustomer(customer); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.CreateCustomer(ctx, customer); err != nil {
+		return nil, err
+	}
+
+	return customer, nil
+}
+
+func (s *OrderManagementService) GetCustomer(ctx context.Context, id int) (*Customer, error) {
+	return s.repo.GetCustomerByID(ctx, id)
+}
+
+func (s *OrderManagementService) ListCustomers(ctx context.Context, filter CustomerFilter) (*CustomerPage, error) {
+
+	var err error
+	if filter.Limit, filter.AfterID, err = idPageBounds(filter.Limit, filter.Cursor); err != nil {
+		return nil, err
+	}
+
+	customers, next, err := listPage(filter.Limit, func(limit int) ([]*Customer, error) {
+		query := filter
+		query.Limit = limit
+		return s.repo.ListCustomers(ctx, query)
+	}, func(last *Customer) (any, error) {
+		return idCursor(last.CustomerId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CustomerPage{Customers: customers, NextCursor: next}, nil
+}
+
+func (s *OrderManagementService) UpdateCustomer(ctx context.Context, id int, name, email string) (*Customer, error) {
+
+	customer, err := s.repo.GetCustomerByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if customer.DeletedAt != nil {
+		return nil, fmt.Errorf("customer id %d %w", id, ErrNotFound)
+	}
+
+	customer.Name = name
+	customer.Email = email
+	if err := validateCustomer(customer); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.UpdateCustomer(ctx, customer); err != nil {
+		return nil, err
+	}
+
+	return customer, nil
+}
+
+// DeleteCustomer soft deletes the customer so their order history is kept
+func (s *OrderManagementService) DeleteCustomer(ctx context.Context, id int) error {
+	return s.repo.DeleteCustomer(ctx, id)
+}
+
+// ListCustomerOrders lists the order history of a customer, deleted customers included
+func (s *OrderManagementService) ListCustomerOrders(ctx context.Context, id int, filter OrderFilter) (*OrderPage, error) {
+
+	customer, err := s.repo.GetCustomerByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	filter.CustomerId = customer.CustomerId
+	return s.ListOrders(ctx, filter)
+}
+
+func validateCustomer(customer *Customer) error {
+	customer.Name = strings.TrimSpace(customer.Name)
+	if customer.Name == "" {
+		return fmt.Errorf("customer name is required")
+	}
+	if len(customer.Name) > maxNameLength {
+		return fmt.Errorf("customer name must be at most %d characters", maxNameLength)
+	}
+
+	customer.Email = strings.TrimSpace(customer.Email)
+	if len(customer.Email) > maxNameLength {
+		return fmt.Errorf("customer email must be at most %d characters", maxNameLength)
+	}
+
+	// Only accept a bare address, not "Name <address>"
+	address, err := mail.ParseAddress(customer.Email)
+	if err != nil || address.Address != customer.Email {
+		return fmt.Errorf("invalid customer email %s", customer.Email)
+	}
+
+	// Require a dotted domain such as example.com
+	if domain := customer.Email[strings.LastIndex(customer.Email, "@")+1:]; !strings.Contains(domain, ".") {
+		return fmt.Errorf("invalid customer email %s", customer.Email)
+	}
+
+	return nil
+}
+
+// pageLimit applies the default page size and checks the upper bound
+func pageLimit(limit int) (int, error) {
+	switch {
+	case limit == 0:
+		return defaultListLimit, nil
+	case limit < 0 || limit > maxListLimit:
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+	}
+	return limit, nil
+}
+
+// listPage lists one row more than limit with list to find out whether another page
+// exists. It returns the rows of the page and the cursor of the next page, empty on
+// the last page.
+func listPage[T any](limit int, list func(limit int) ([]T, error), cursorOf func(last T) (any, error)) ([]T, string, error) {
+	rows, err := list(limit + 1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(rows) <= limit {
+		return rows, "", nil
+	}
+
+	rows = rows[:limit]
+	cursor, err := cursorOf(rows[len(rows)-1])
+	if err != nil {
+		return nil, "", err
+	}
+
+	next, err := encodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	return rows, next, nil
+}
+
+// idPageBounds returns the page size and the id to continue after, 0 for the first
+// page, of a list ordered by id
+func idPageBounds(limit int, token string) (int, int, error) {
+	limit, err := pageLimit(limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if token == "" {
+		return limit, 0, nil
+	}
+
+	cursor := new(IDCursor)
+	if err := decodeCursor(token, cursor); err != nil {
+		return 0, 0, err
+	}
+	return limit, cursor.ID, nil
+}
+
+func idCursor(id string) (any, error) {
+	lastId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+	return &IDCursor{ID: lastId}, nil
 }
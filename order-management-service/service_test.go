@@ -0,0 +1,806 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+func TestValidateOrderFilter(t *testing.T) {
+	from := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	cursor, err := encodeCursor(&OrderCursor{SortBy: SortByCreatedAt, ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		filter  OrderFilter
+		want    OrderFilter
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			filter: OrderFilter{},
+			want:   OrderFilter{SortBy: SortByCreatedAt, Limit: defaultListLimit},
+		},
+		{
+			name:   "all criteria",
+			filter: OrderFilter{CustomerId: "1", ProductId: "2", Status: OrderPending, CreatedFrom: &from, CreatedTo: &to, SortBy: SortByUpdatedAt, Descending: true, Limit: 5},
+			want:   OrderFilter{CustomerId: "1", ProductId: "2", Status: OrderPending, CreatedFrom: &from, CreatedTo: &to, SortBy: SortByUpdatedAt, Descending: true, Limit: 5},
+		},
+		{
+			name:   "cursor",
+			filter: OrderFilter{Cursor: cursor},
+			want:   OrderFilter{SortBy: SortByCreatedAt, Limit: defaultListLimit, Cursor: cursor, After: &OrderCursor{SortBy: SortByCreatedAt, ID: 1}},
+		},
+		{name: "customer id", filter: OrderFilter{CustomerId: "luke"}, wantErr: "invalid customer id"},
+		{name: "product id", filter: OrderFilter{ProductId: "mug"}, wantErr: "invalid product id"},
+		{name: "status", filter: OrderFilter{Status: "Shipped"}, wantErr: "invalid order status"},
+		{name: "date range", filter: OrderFilter{CreatedFrom: &to, CreatedTo: &from}, wantErr: "createdFrom must be before createdTo"},
+		{name: "sort key", filter: OrderFilter{SortBy: "price"}, wantErr: "invalid sort key"},
+		{name: "negative limit", filter: OrderFilter{Limit: -1}, wantErr: "limit must be between"},
+		{name: "large limit", filter: OrderFilter{Limit: maxListLimit + 1}, wantErr: "limit must be between"},
+		{name: "invalid cursor", filter: OrderFilter{Cursor: "abc"}, wantErr: "invalid cursor"},
+		{name: "cursor of another order", filter: OrderFilter{Cursor: cursor, Descending: true}, wantErr: "cursor does not match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+			err := validateOrderFilter(&filter)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateOrderFilter() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateOrderFilter() failed: %v", err)
+			}
+
+			if filter.SortBy != tt.want.SortBy || filter.Descending != tt.want.Descending || filter.Limit != tt.want.Limit {
+				t.Errorf("sort %s descending %v limit %d, want %s %v %d",
+					filter.SortBy, filter.Descending, filter.Limit, tt.want.SortBy, tt.want.Descending, tt.want.Limit)
+			}
+			if (filter.After == nil) != (tt.want.After == nil) || (filter.After != nil && *filter.After != *tt.want.After) {
+				t.Errorf("After = %+v, want %+v", filter.After, tt.want.After)
+			}
+		})
+	}
+}
+
+// orderListStore returns the orders it holds after the cursor, it implements
+// only the ListOrders method of Storage
+type orderListStore struct {
+	Storage
+	orders []*Order
+}
+
+func (s *orderListStore) ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error) {
+	orders := s.orders
+	if filter.After != nil {
+		for i, order := range orders {
+			if order.ID == filter.After.ID {
+				orders = orders[i+1:]
+				break
+			}
+		}
+	}
+	return orders[:min(filter.Limit, len(orders))], nil
+}
+
+func TestListOrdersPages(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+	repo := &orderListStore{}
+	for i, id := range []OrderID{1, 2, 3, 4, 5} {
+		repo.orders = append(repo.orders, &Order{ID: id, CreatedAt: created.Add(time.Duration(i) * time.Minute)})
+	}
+	svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+	tests := []struct {
+		limit int
+		want  [][]OrderID
+	}{
+		{limit: 2, want: [][]OrderID{{1, 2}, {3, 4}, {5}}},
+		{limit: 5, want: [][]OrderID{{1, 2, 3, 4, 5}}},
+		{limit: 10, want: [][]OrderID{{1, 2, 3, 4, 5}}},
+	}
+
+	for _, tt := range tests {
+		var pages [][]OrderID
+		filter := OrderFilter{Limit: tt.limit}
+		for {
+			page, err := svc.ListOrders(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []OrderID
+			for _, order := range page.Orders {
+				ids = append(ids, order.ID)
+			}
+			pages = append(pages, ids)
+
+			if page.NextCursor == "" {
+				break
+			}
+			filter.Cursor = page.NextCursor
+		}
+
+		if !reflect.DeepEqual(pages, tt.want) {
+			t.Errorf("pages of %d = %v, want %v", tt.limit, pages, tt.want)
+		}
+	}
+}
+
+func TestListPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     []int
+		limit    int
+		want     []int
+		wantNext bool
+	}{
+		{name: "empty", rows: nil, limit: 2, want: nil},
+		{name: "last page", rows: []int{1, 2}, limit: 2, want: []int{1, 2}},
+		{name: "more pages", rows: []int{1, 2, 3, 4}, limit: 2, want: []int{1, 2}, wantNext: true},
+	}
+
+	for _, tt := range tests {
+		var listed int
+		got, next, err := listPage(tt.limit, func(limit int) ([]int, error) {
+			listed = limit
+			return tt.rows[:min(limit, len(tt.rows))], nil
+		}, func(last int) (any, error) {
+			return &IDCursor{ID: last}, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: listPage() failed: %v", tt.name, err)
+		}
+
+		// One more row is listed to find out whether another page exists
+		if listed != tt.limit+1 {
+			t.Errorf("%s: listed %d rows, want %d", tt.name, listed, tt.limit+1)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: page = %v, want %v", tt.name, got, tt.want)
+		}
+		if (next != "") != tt.wantNext {
+			t.Errorf("%s: next cursor = %q, want one %v", tt.name, next, tt.wantNext)
+		}
+		if next == "" {
+			continue
+		}
+
+		// The next page continues after the last row of the page
+		_, afterId, err := idPageBounds(tt.limit, next)
+		if err != nil || afterId != tt.want[len(tt.want)-1] {
+			t.Errorf("%s: next cursor continues after %d, %v, want %d", tt.name, afterId, err, tt.want[len(tt.want)-1])
+		}
+	}
+
+	listErr := errors.New("list failed")
+	if _, _, err := listPage(2, func(int) ([]int, error) { return nil, listErr }, nil); !errors.Is(err, listErr) {
+		t.Errorf("listPage() = %v, want the list error", err)
+	}
+}
+
+func TestIDPageBounds(t *testing.T) {
+	token, err := encodeCursor(&IDCursor{ID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		limit       int
+		token       string
+		wantLimit   int
+		wantAfterId int
+		wantErr     bool
+	}{
+		{limit: 0, token: "", wantLimit: defaultListLimit, wantAfterId: 0},
+		{limit: 5, token: token, wantLimit: 5, wantAfterId: 42},
+		{limit: maxListLimit + 1, token: "", wantErr: true},
+		{limit: -1, token: "", wantErr: true},
+		{limit: 5, token: "abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		limit, afterId, err := idPageBounds(tt.limit, tt.token)
+		if (err != nil) != tt.wantErr || limit != tt.wantLimit || afterId != tt.wantAfterId {
+			t.Errorf("idPageBounds(%d, %q) = %d, %d, %v, want %d, %d", tt.limit, tt.token, limit, afterId, err, tt.wantLimit, tt.wantAfterId)
+		}
+	}
+
+	if _, err := idCursor("mug"); err == nil {
+		t.Error("idCursor() of a non numeric id succeeded")
+	}
+}
+
+// orderStatusStore holds a single order and the outbox messages saved with its
+// status, it implements only the order lookup and the conditional status update of Storage.
+// A non empty changedTo is the status a concurrent request moves the order to just
+// before the next update.
+type orderStatusStore struct {
+	Storage
+	order     Order
+	messages  []*OutboxMessage
+	changedTo string
+}
+
+func (s *orderStatusStore) GetOrderByID(ctx context.Context, id OrderID) (*Order, error) {
+	if id != s.order.ID {
+		return nil, fmt.Errorf("order id %d %w", id, ErrNotFound)
+	}
+	order := s.order
+	return &order, nil
+}
+
+func (s *orderStatusStore) UpdateOrderStatus(ctx context.Context, orderId OrderID, currentStatus, status string, message *OutboxMessage) error {
+	if s.changedTo != "" {
+		s.order.Status, s.changedTo = s.changedTo, ""
+	}
+	if s.order.Status != currentStatus {
+		return fmt.Errorf("%w: order %s is no longer %s", ErrOrderStatusChanged, orderId, currentStatus)
+	}
+	s.order.Status = status
+	if message != nil {
+		s.messages = append(s.messages, message)
+	}
+	return nil
+}
+
+func (s *orderStatusStore) CreateOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+// paymentTypes returns the type of the payment requests saved to the outbox
+func (s *orderStatusStore) paymentTypes(t *testing.T) []string {
+	t.Helper()
+	var types []string
+	for _, message := range s.messages {
+		var req common.PaymentRequest
+		if err := json.Unmarshal(message.Payload, &req); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, req.Type)
+	}
+	return types
+}
+
+func TestCancelOrder(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		status       string
+		wantStatus   string
+		wantPayments []string
+		wantErr      error
+	}{
+		{status: OrderPending, wantStatus: OrderCanceled},
+		{status: OrderAuthorized, wantStatus: OrderVoiding, wantPayments: []string{common.PaymentVoid}},
+		{status: OrderFulfilled, wantStatus: OrderRefunding, wantPayments: []string{common.PaymentRefund}},
+		{status: OrderConfirmed, wantStatus: OrderRefunding, wantPayments: []string{common.PaymentRefund}},
+		{status: OrderCapturing, wantStatus: OrderCapturing, wantErr: ErrInvalidTransition},
+		// Voiding orders are canceled once their hold is released
+		{status: OrderVoiding, wantStatus: OrderVoiding, wantErr: ErrInvalidTransition},
+		{status: OrderRefunding, wantStatus: OrderRefunding, wantErr: ErrInvalidTransition},
+		{status: OrderCanceled, wantStatus: OrderCanceled, wantErr: ErrInvalidTransition},
+		{status: OrderRefunded, wantStatus: OrderRefunded, wantErr: ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		repo := &orderStatusStore{order: Order{ID: 7, Status: tt.status}}
+		svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+		_, err := svc.CancelOrder(ctx, 7, "")
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("CancelOrder() of a %s order = %v, want %v", tt.status, err, tt.wantErr)
+		}
+		if repo.order.Status != tt.wantStatus {
+			t.Errorf("canceled %s order is %s, want %s", tt.status, repo.order.Status, tt.wantStatus)
+		}
+		if got := repo.paymentTypes(t); !reflect.DeepEqual(got, tt.wantPayments) {
+			t.Errorf("canceling a %s order saved payment requests %q, want %q", tt.status, got, tt.wantPayments)
+		}
+	}
+
+	svc := NewOrderManagementService(&orderStatusStore{order: Order{ID: 7, Status: OrderPending}}, &ServerConfig{}, newTestIDs(t))
+	if _, err := svc.CancelOrder(ctx, 8, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("CancelOrder() of an unknown order = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFulfillOrder(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		status       string
+		wantStatus   string
+		wantPayments []string
+		wantErr      error
+	}{
+		{status: OrderAuthorized, wantStatus: OrderCapturing, wantPayments: []string{common.PaymentCapture}},
+		{status: OrderPending, wantStatus: OrderPending, wantErr: ErrInvalidTransition},
+		{status: OrderCapturing, wantStatus: OrderCapturing, wantErr: ErrInvalidTransition},
+		{status: OrderFulfilled, wantStatus: OrderFulfilled, wantErr: ErrInvalidTransition},
+		{status: OrderConfirmed, wantStatus: OrderConfirmed, wantErr: ErrInvalidTransition},
+		{status: OrderCanceled, wantStatus: OrderCanceled, wantErr: ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		repo := &orderStatusStore{order: Order{ID: 7, Status: tt.status}}
+		svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+		_, err := svc.FulfillOrder(ctx, 7, "")
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("FulfillOrder() of a %s order = %v, want %v", tt.status, err, tt.wantErr)
+		}
+		if repo.order.Status != tt.wantStatus {
+			t.Errorf("fulfilled %s order is %s, want %s", tt.status, repo.order.Status, tt.wantStatus)
+		}
+		if got := repo.paymentTypes(t); !reflect.DeepEqual(got, tt.wantPayments) {
+			t.Errorf("fulfilling a %s order saved payment requests %q, want %q", tt.status, got, tt.wantPayments)
+		}
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		status       string
+		paymentType  string
+		paymentState string
+		wantStatus   string
+		wantPayments []string
+		wantErr      error
+	}{
+		{status: OrderPending, paymentType: common.PaymentAuthorize, paymentState: common.PaymentAuthorized, wantStatus: OrderAuthorized},
+		{status: OrderPending, paymentType: common.PaymentAuthorize, paymentState: common.PaymentFailed, wantStatus: OrderCanceled},
+		{status: OrderCapturing, paymentType: common.PaymentCapture, paymentState: common.PaymentCaptured, wantStatus: OrderFulfilled},
+		{status: OrderCapturing, paymentType: common.PaymentCapture, paymentState: common.PaymentFailed, wantStatus: OrderVoiding, wantPayments: []string{common.PaymentVoid}},
+		{status: OrderVoiding, paymentType: common.PaymentVoid, paymentState: common.PaymentVoided, wantStatus: OrderCanceled},
+		{status: OrderRefunding, paymentType: common.PaymentRefund, paymentState: common.PaymentRefunded, wantStatus: OrderRefunded},
+
+		// Responses without a type answer authorizations, payment services that
+		// predate authorizations pay orders in a single step
+		{status: OrderPending, paymentState: common.PaymentSuccessfull, wantStatus: OrderConfirmed},
+
+		// The hold of an order canceled while its payment was authorized is voided
+		{status: OrderCanceled, paymentType: common.PaymentAuthorize, paymentState: common.PaymentAuthorized, wantStatus: OrderCanceled, wantPayments: []string{common.PaymentVoid}},
+
+		// A response delivered again after it was applied is ignored
+		{status: OrderAuthorized, paymentType: common.PaymentAuthorize, paymentState: common.PaymentAuthorized, wantStatus: OrderAuthorized},
+		{status: OrderFulfilled, paymentType: common.PaymentAuthorize, paymentState: common.PaymentAuthorized, wantStatus: OrderFulfilled},
+		{status: OrderFulfilled, paymentType: common.PaymentCapture, paymentState: common.PaymentCaptured, wantStatus: OrderFulfilled},
+		{status: OrderRefunded, paymentType: common.PaymentRefund, paymentState: common.PaymentRefunded, wantStatus: OrderRefunded},
+		{status: OrderVoiding, paymentType: common.PaymentCapture, paymentState: common.PaymentFailed, wantStatus: OrderVoiding},
+
+		// Late responses for orders that moved on are rejected
+		{status: OrderCanceled, paymentState: common.PaymentSuccessfull, wantStatus: OrderCanceled, wantErr: ErrInvalidTransition},
+		{status: OrderConfirmed, paymentType: common.PaymentRefund, paymentState: common.PaymentRefunded, wantStatus: OrderConfirmed, wantErr: ErrInvalidTransition},
+		{status: OrderAuthorized, paymentType: common.PaymentCapture, paymentState: common.PaymentCaptured, wantStatus: OrderAuthorized, wantErr: ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		repo := &orderStatusStore{order: Order{ID: 7, Status: tt.status}}
+		svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+		response := common.PaymentResponse{OrderID: "7", Type: tt.paymentType, PaymentStatus: tt.paymentState}
+		err := svc.UpdateOrderStatus(ctx, 7, response, "")
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("UpdateOrderStatus(%s %s) of a %s order = %v, want %v", tt.paymentType, tt.paymentState, tt.status, err, tt.wantErr)
+		}
+		if repo.order.Status != tt.wantStatus {
+			t.Errorf("%s order is %s after %s %s, want %s", tt.status, repo.order.Status, tt.paymentType, tt.paymentState, tt.wantStatus)
+		}
+		if got := repo.paymentTypes(t); !reflect.DeepEqual(got, tt.wantPayments) {
+			t.Errorf("%s %s of a %s order saved payment requests %q, want %q", tt.paymentType, tt.paymentState, tt.status, got, tt.wantPayments)
+		}
+	}
+
+	// The order is canceled while its authorization is applied, the response is
+	// applied again to the canceled order and voids the hold
+	repo := &orderStatusStore{order: Order{ID: 7, Status: OrderPending}, changedTo: OrderCanceled}
+	svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+	authorized := common.PaymentResponse{OrderID: "7", Type: common.PaymentAuthorize, PaymentStatus: common.PaymentAuthorized}
+	if err := svc.UpdateOrderStatus(ctx, 7, authorized, ""); err != nil {
+		t.Errorf("UpdateOrderStatus() of an order canceled concurrently = %v", err)
+	}
+	if got := repo.paymentTypes(t); repo.order.Status != OrderCanceled || !reflect.DeepEqual(got, []string{common.PaymentVoid}) {
+		t.Errorf("order canceled concurrently is %s with payment requests %q, want %s with a void", repo.order.Status, got, OrderCanceled)
+	}
+
+	svc = NewOrderManagementService(&orderStatusStore{order: Order{ID: 7, Status: OrderPending}}, &ServerConfig{}, newTestIDs(t))
+	lost := common.PaymentResponse{OrderID: "7", Type: common.PaymentCapture, PaymentStatus: common.PaymentVoided}
+	if err := svc.UpdateOrderStatus(ctx, 7, lost, ""); !errors.Is(err, ErrInvalidPaymentStatus) {
+		t.Errorf("UpdateOrderStatus() with an unknown payment status = %v, want ErrInvalidPaymentStatus", err)
+	}
+}
+
+func TestValidateProduct(t *testing.T) {
+	tests := []struct {
+		name     string
+		product  Product
+		wantName string
+		wantErr  string
+	}{
+		{name: "valid", product: Product{Name: "Mug", Price: usd("10")}, wantName: "Mug"},
+		{name: "trimmed name", product: Product{Name: "  Mug ", Price: usd("9.99")}, wantName: "Mug"},
+		{name: "largest price", product: Product{Name: "Mug", Price: usd("99999999.99")}, wantName: "Mug"},
+		{name: "empty name", product: Product{Name: "  ", Price: usd("10")}, wantErr: "product name is required"},
+		{name: "long name", product: Product{Name: strings.Repeat("a", maxNameLength+1), Price: usd("10")}, wantErr: "at most 100 characters"},
+		{name: "zero price", product: Product{Name: "Mug", Price: usd("0")}, wantErr: "greater than 0"},
+		{name: "negative price", product: Product{Name: "Mug", Price: usd("-1")}, wantErr: "greater than 0"},
+		{name: "large price", product: Product{Name: "Mug", Price: usd("100000000")}, wantErr: "greater than 0"},
+		{name: "other currency", product: Product{Name: "Mug", Price: common.MustParseMoney("10", "EUR")}, wantName: "Mug"},
+		{name: "prices", product: Product{Name: "Mug", Price: usd("10"), Prices: []common.Money{common.MustParseMoney("9", "EUR"), common.MustParseMoney("1500", "JPY")}}, wantName: "Mug"},
+		{name: "free price", product: Product{Name: "Mug", Price: usd("10"), Prices: []common.Money{common.MustParseMoney("0", "EUR")}}, wantErr: "greater than 0"},
+		{name: "duplicate currency", product: Product{Name: "Mug", Price: usd("10"), Prices: []common.Money{usd("11")}}, wantErr: "more than one price in USD"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product := tt.product
+			err := validateProduct(&product)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateProduct() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateProduct() failed: %v", err)
+			}
+			if product.Name != tt.wantName {
+				t.Errorf("name = %q, want %q", product.Name, tt.wantName)
+			}
+		})
+	}
+}
+
+// productListStore returns the products it holds after AfterID, it implements
+// only the ListProducts method of Storage
+type productListStore struct {
+	Storage
+	products []*Product
+}
+
+func (s *productListStore) ListProducts(ctx context.Context, filter ProductFilter) ([]*Product, error) {
+	var products []*Product
+	for _, product := range s.products {
+		id, _ := strconv.Atoi(product.ProductId)
+		if id > filter.AfterID && len(products) < filter.Limit {
+			products = append(products, product)
+		}
+	}
+	return products, nil
+}
+
+func TestListProductsPages(t *testing.T) {
+	ctx := context.Background()
+	repo := &productListStore{}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		repo.products = append(repo.products, &Product{ProductId: id, Name: "Mug", Price: usd("10")})
+	}
+	svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+	tests := []struct {
+		limit int
+		want  [][]string
+	}{
+		{limit: 2, want: [][]string{{"1", "2"}, {"3", "4"}, {"5"}}},
+		{limit: 5, want: [][]string{{"1", "2", "3", "4", "5"}}},
+		{limit: 0, want: [][]string{{"1", "2", "3", "4", "5"}}},
+	}
+
+	for _, tt := range tests {
+		var pages [][]string
+		filter := ProductFilter{Limit: tt.limit}
+		for {
+			page, err := svc.ListProducts(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, product := range page.Products {
+				ids = append(ids, product.ProductId)
+			}
+			pages = append(pages, ids)
+
+			if page.NextCursor == "" {
+				break
+			}
+			filter.Cursor = page.NextCursor
+		}
+
+		if !reflect.DeepEqual(pages, tt.want) {
+			t.Errorf("pages of %d = %v, want %v", tt.limit, pages, tt.want)
+		}
+	}
+
+	for _, filter := range []ProductFilter{{Limit: -1}, {Limit: maxListLimit + 1}, {Cursor: "abc"}} {
+		if _, err := svc.ListProducts(ctx, filter); err == nil {
+			t.Errorf("ListProducts(%+v) succeeded, want an error", filter)
+		}
+	}
+}
+
+func TestValidateCustomer(t *testing.T) {
+	tests := []struct {
+		name      string
+		customer  Customer
+		wantEmail string
+		wantErr   string
+	}{
+		{name: "valid", customer: Customer{Name: "Jane", Email: "jane@example.com"}, wantEmail: "jane@example.com"},
+		{name: "trimmed", customer: Customer{Name: " Jane ", Email: " jane@example.com "}, wantEmail: "jane@example.com"},
+		{name: "subdomain", customer: Customer{Name: "Jane", Email: "jane.doe+oms@mail.example.co.uk"}, wantEmail: "jane.doe+oms@mail.example.co.uk"},
+		{name: "empty name", customer: Customer{Name: " ", Email: "jane@example.com"}, wantErr: "customer name is required"},
+		{name: "long name", customer: Customer{Name: strings.Repeat("a", maxNameLength+1), Email: "jane@example.com"}, wantErr: "customer name must be at most"},
+		{name: "long email", customer: Customer{Name: "Jane", Email: strings.Repeat("a", maxNameLength) + "@example.com"}, wantErr: "customer email must be at most"},
+		{name: "empty email", customer: Customer{Name: "Jane"}, wantErr: "invalid customer email"},
+		{name: "no at", customer: Customer{Name: "Jane", Email: "jane.example.com"}, wantErr: "invalid customer email"},
+		{name: "display name", customer: Customer{Name: "Jane", Email: "Jane <jane@example.com>"}, wantErr: "invalid customer email"},
+		{name: "undotted domain", customer: Customer{Name: "Jane", Email: "jane@localhost"}, wantErr: "invalid customer email"},
+		{name: "two addresses", customer: Customer{Name: "Jane", Email: "jane@example.com, joe@example.com"}, wantErr: "invalid customer email"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			customer := tt.customer
+			err := validateCustomer(&customer)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateCustomer() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateCustomer() failed: %v", err)
+			}
+			if customer.Email != tt.wantEmail {
+				t.Errorf("email = %q, want %q", customer.Email, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestCustomerLifecycle(t *testing.T) {
+	ctx := context.Background()
+	svc := NewOrderManagementService(NewMemoryStore(), &ServerConfig{}, newTestIDs(t))
+
+	jane, err := svc.CreateCustomer(ctx, " Jane ", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jane.CustomerId != "1" || jane.Name != "Jane" {
+		t.Errorf("created %+v, want customer 1 named Jane", jane)
+	}
+	if _, err := svc.CreateCustomer(ctx, "Jane", "jane"); err == nil || !strings.Contains(err.Error(), "invalid customer email") {
+		t.Errorf("CreateCustomer() with an invalid email = %v", err)
+	}
+	if _, err := svc.CreateCustomer(ctx, "Other Jane", "jane@example.com"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("CreateCustomer() with a used email = %v, want ErrEmailTaken", err)
+	}
+
+	joe, err := svc.CreateCustomer(ctx, "Joe", "joe@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.UpdateCustomer(ctx, 2, "Joe", "jane@example.com"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("UpdateCustomer() to a used email = %v, want ErrEmailTaken", err)
+	}
+	updated, err := svc.UpdateCustomer(ctx, 2, "Joseph", "joseph@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := svc.GetCustomer(ctx, 2); *got != *updated || got.Name != "Joseph" {
+		t.Errorf("GetCustomer() = %+v after update, want %+v", got, updated)
+	}
+
+	if err := svc.DeleteCustomer(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.DeleteCustomer(ctx, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second DeleteCustomer() = %v, want ErrNotFound", err)
+	}
+	if _, err := svc.UpdateCustomer(ctx, 1, "Jane", "jane@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateCustomer() of a deleted customer = %v, want ErrNotFound", err)
+	}
+
+	// Deleted customers can still be read for their order history
+	deleted, err := svc.GetCustomer(ctx, 1)
+	if err != nil || deleted.DeletedAt == nil {
+		t.Errorf("GetCustomer() of a deleted customer = %+v, %v", deleted, err)
+	}
+
+	// The email of a deleted customer can be used again
+	if _, err := svc.CreateCustomer(ctx, "New Jane", "jane@example.com"); err != nil {
+		t.Errorf("CreateCustomer() with the email of a deleted customer failed: %v", err)
+	}
+
+	tests := []struct {
+		filter CustomerFilter
+		want   []string
+	}{
+		{filter: CustomerFilter{}, want: []string{joe.CustomerId, "3"}},
+		{filter: CustomerFilter{IncludeDeleted: true}, want: []string{jane.CustomerId, joe.CustomerId, "3"}},
+		{filter: CustomerFilter{IncludeDeleted: true, Limit: 2}, want: []string{jane.CustomerId, joe.CustomerId}},
+	}
+	for _, tt := range tests {
+		page, err := svc.ListCustomers(ctx, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, customer := range page.Customers {
+			ids = append(ids, customer.CustomerId)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("ListCustomers(%+v) = %v, want %v", tt.filter, ids, tt.want)
+		}
+		if (page.NextCursor != "") != (tt.filter.Limit == 2) {
+			t.Errorf("ListCustomers(%+v) next cursor %q", tt.filter, page.NextCursor)
+		}
+	}
+}
+
+// inventoryStore holds the stock of a single product, it implements only the
+// product lookup and inventory update of Storage
+type inventoryStore struct {
+	Storage
+	product   Product
+	inventory *Inventory
+}
+
+func (s *inventoryStore) GetProductByID(ctx context.Context, id int) (*Product, error) {
+	if strconv.Itoa(id) != s.product.ProductId {
+		return nil, fmt.Errorf("product id %d %w", id, ErrNotFound)
+	}
+	product := s.product
+	return &product, nil
+}
+
+func (s *inventoryStore) SetInventory(ctx context.Context, productId int, onHand int64) (*Inventory, error) {
+	s.inventory = &Inventory{ProductId: strconv.Itoa(productId), OnHand: onHand, Available: onHand}
+	return s.inventory, nil
+}
+
+func TestSetInventory(t *testing.T) {
+	ctx := context.Background()
+	retired := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		product   Product
+		productId int
+		onHand    int64
+		wantErr   string
+	}{
+		{name: "stock", product: Product{ProductId: "1"}, productId: 1, onHand: 5},
+		{name: "no stock", product: Product{ProductId: "1"}, productId: 1, onHand: 0},
+		{name: "negative stock", product: Product{ProductId: "1"}, productId: 1, onHand: -1, wantErr: "stock on hand cannot be negative"},
+		{name: "unknown product", product: Product{ProductId: "1"}, productId: 2, onHand: 5, wantErr: ErrNotFound.Error()},
+		{name: "retired product", product: Product{ProductId: "1", DeletedAt: &retired}, productId: 1, onHand: 5, wantErr: ErrProductRetired.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &inventoryStore{product: tt.product}
+			svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+			inventory, err := svc.SetInventory(ctx, tt.productId, tt.onHand)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SetInventory() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				if repo.inventory != nil {
+					t.Errorf("SetInventory() stored %+v after an error", repo.inventory)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inventory.OnHand != tt.onHand {
+				t.Errorf("on hand = %d, want %d", inventory.OnHand, tt.onHand)
+			}
+		})
+	}
+}
+
+func TestCreateOrderCurrency(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryStore()
+	svc := NewOrderManagementService(repo, &ServerConfig{}, newTestIDs(t))
+
+	customer, err := svc.CreateCustomer(ctx, "Jane", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	product, err := svc.CreateProduct(ctx, "Mug", usd("10"), []common.Money{common.MustParseMoney("9", "EUR")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	productId, _ := strconv.Atoi(product.ProductId)
+	if _, err := svc.SetInventory(ctx, productId, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.CreateExchangeRate(ctx, "USD", "JPY", "150.5", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		currency  string
+		wantTotal common.Money
+		wantErr   error
+	}{
+		{currency: "", wantTotal: usd("20")},
+		{currency: "USD", wantTotal: usd("20")},
+		// The price set for the currency is used instead of a conversion
+		{currency: "EUR", wantTotal: common.MustParseMoney("18", "EUR")},
+		// 10 USD at 150.5 is 1505 JPY
+		{currency: "JPY", wantTotal: common.MustParseMoney("3010", "JPY")},
+		{currency: "GBP", wantErr: ErrNoExchangeRate},
+		{currency: "XYZ", wantErr: common.ErrUnknownCurrency},
+	}
+
+	for _, tt := range tests {
+		items := []OrderItemRequest{{ProductId: product.ProductId, Quantity: 2}}
+		order, err := svc.CreateOrder(ctx, customer.CustomerId, tt.currency, items, "create", nil)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateOrder() in %q = %v, want %v", tt.currency, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("CreateOrder() in %q failed: %v", tt.currency, err)
+			continue
+		}
+		if order.TotalPrice != tt.wantTotal {
+			t.Errorf("order in %q costs %v, want %v", tt.currency, order.TotalPrice, tt.wantTotal)
+		}
+	}
+}
+
+func TestValidateExchangeRate(t *testing.T) {
+	tests := []struct {
+		rate     ExchangeRate
+		wantRate string
+		wantErr  bool
+	}{
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "EUR", Rate: "0.9215"}, wantRate: "0.9215"},
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "JPY", Rate: "150.500"}, wantRate: "150.5"},
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "USD", Rate: "1"}, wantErr: true},
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "XYZ", Rate: "1"}, wantErr: true},
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "EUR", Rate: "0.00000000001"}, wantErr: true},
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "EUR", Rate: "10000000000"}, wantErr: true},
+		{rate: ExchangeRate{BaseCurrency: "USD", QuoteCurrency: "EUR", Rate: "-1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		rate := tt.rate
+		err := validateExchangeRate(&rate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateExchangeRate(%+v) error = %v, want error %v", tt.rate, err, tt.wantErr)
+			continue
+		}
+		if err == nil && rate.Rate != tt.wantRate {
+			t.Errorf("validateExchangeRate(%+v) rate = %s, want %s", tt.rate, rate.Rate, tt.wantRate)
+		}
+	}
+}
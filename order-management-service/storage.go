@@ -1,50 +1,68 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/aayush993/go-order-management/common"
+	"github.com/lib/pq"
 )
 
-// Database Schema
-const dbSchema = `create table if not exists customers (
-	customer_id serial primary key,
-	name varchar(100) NOT NULL,
-	email varchar(100)
-);
-
-create table if not exists products (
-	product_id serial primary key,
-	name varchar(100) NOT NULL,
-	price DECIMAL(10, 2) NOT NULL
-);
-
-create table if not exists orders (
-	id serial primary key,
-	customer_id INT NOT NULL,
-	product_id INT NOT NULL,
-	quantity INT NOT NULL,
-	total_price DECIMAL(10,2) NOT NULL,
-	status varchar(50) NOT NULL,
-	created_at timestamp NOT NULL,
-	updated_at timestamp NOT NULL,
-	FOREIGN KEY (customer_id) REFERENCES customers(customer_id),
-	FOREIGN KEY (product_id) REFERENCES products(product_id)
-);
-`
-
 type Storage interface {
-	CreateOrder(*Order) error
-	CreateProduct(*Product) error
-	CreateCustomer(*Customer) error
-
-	GetOrderByID(int) (*Order, error)
-	GetProductByID(int) (*Product, error)
-	GetCustomerByID(int) (*Customer, error)
-
-	UpdateOrderStatus(string, string) error
+	// CreateOrder saves the order, the outbox message announcing it and the
+	// optional idempotency key atomically. It returns ErrIdempotencyKeyExists
+	// if the key was already stored.
+	CreateOrder(context.Context, *Order, *OutboxMessage, *IdempotencyKey) error
+	CreateProduct(context.Context, *Product) error
+	CreateCustomer(context.Context, *Customer) error
+
+	GetOrderByID(context.Context, OrderID) (*Order, error)
+	GetProductByID(context.Context, int) (*Product, error)
+	GetCustomerByID(context.Context, int) (*Customer, error)
+
+	ListOrders(context.Context, OrderFilter) ([]*Order, error)
+	ListProducts(context.Context, ProductFilter) ([]*Product, error)
+	ListCustomers(context.Context, CustomerFilter) ([]*Customer, error)
+
+	UpdateProduct(context.Context, *Product) error
+	DeleteProduct(context.Context, int) error
+	UpdateCustomer(context.Context, *Customer) error
+	DeleteCustomer(context.Context, int) error
+
+	// UpdateOrderStatus also settles the stock reserved for the order: it is released
+	// on cancellation and taken from stock on fulfillment and confirmation. A non nil
+	// outbox message is saved with the new status. It returns ErrOrderStatusChanged
+	// when the order is no longer in the given current status.
+	UpdateOrderStatus(context.Context, OrderID, string, string, *OutboxMessage) error
+
+	GetInventory(context.Context, int) (*Inventory, error)
+	SetInventory(context.Context, int, int64) (*Inventory, error)
+
+	// CreateExchangeRate saves the rate, replacing the rate of the currency pair with the same effective time
+	CreateExchangeRate(context.Context, *ExchangeRate) error
+
+	// GetExchangeRate returns the latest rate of the currency pair that took effect at or
+	// before the given time, and ErrNotFound when there is none
+	GetExchangeRate(context.Context, string, string, time.Time) (*ExchangeRate, error)
+
+	// GetIdempotencyKey returns ErrNotFound for unknown and expired keys
+	GetIdempotencyKey(context.Context, string) (*IdempotencyKey, error)
+
+	// ClaimOutboxMessages returns unpublished messages that are due, oldest first,
+	// and hides them from other relays for the lease duration
+	ClaimOutboxMessages(context.Context, int, time.Duration) ([]*OutboxMessage, error)
+	CreateOutboxMessage(context.Context, *OutboxMessage) error
+	MarkOutboxMessagePublished(context.Context, int64) error
+	MarkOutboxMessageFailed(context.Context, int64, string, time.Time) error
+
+	// Close releases the connections of the storage
+	Close() error
 }
 
 type PostgresStore struct {
@@ -67,63 +85,296 @@ func NewPostgresStore(config *DbConfig) (*PostgresStore, error) {
 	}, nil
 }
 
-func (s *PostgresStore) CreateTables() error {
-	_, err := s.db.Exec(dbSchema)
-	return err
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
 }
 
-func (s *PostgresStore) GetOrderByID(id int) (*Order, error) {
-	rows, err := s.db.Query("select * from orders where id = $1", id)
+const orderColumns = "id, customer_id, total_price, currency, status, created_at, updated_at"
+
+func (s *PostgresStore) GetOrderByID(ctx context.Context, id OrderID) (*Order, error) {
+	rows, err := s.db.QueryContext(ctx, "select "+orderColumns+" from orders where id = $1", id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("order id %s %w", id, ErrNotFound)
+	}
+
+	order, err := scanOrderValues(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadOrderItems(ctx, order); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// loadOrderItems fills in the line items of the given orders with a single query
+func (s *PostgresStore) loadOrderItems(ctx context.Context, orders ...*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[OrderID]*Order, len(orders))
+	ids := make([]int64, 0, len(orders))
+	for _, order := range orders {
+		order.Items = []OrderItem{}
+		byID[order.ID] = order
+		ids = append(ids, int64(order.ID))
+	}
+
+	query := `select order_id, product_id, quantity, unit_price, subtotal
+	from order_items where order_id = any($1) order by order_id, line_no`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
-		return scanOrderValues(rows)
+		var (
+			orderId             OrderID
+			item                OrderItem
+			unitPrice, subtotal string
+		)
+		if err := rows.Scan(&orderId, &item.ProductId, &item.Quantity, &unitPrice, &subtotal); err != nil {
+			return err
+		}
+
+		order, ok := byID[orderId]
+		if !ok {
+			continue
+		}
+		if item.UnitPrice, err = common.ParseMoney(unitPrice, order.TotalPrice.Currency); err != nil {
+			return err
+		}
+		if item.Subtotal, err = common.ParseMoney(subtotal, order.TotalPrice.Currency); err != nil {
+			return err
+		}
+		order.Items = append(order.Items, item)
+	}
+
+	return rows.Err()
+}
+
+const customerColumns = "customer_id, name, email, deleted_at"
+
+func (s *PostgresStore) GetCustomerByID(ctx context.Context, id int) (*Customer, error) {
+
+	rows, err := s.db.QueryContext(ctx, "select "+customerColumns+" from customers where customer_id = $1", id)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return nil, fmt.Errorf("order id %d not found", id)
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("customer id %d %w", id, ErrNotFound)
+	}
+
+	return scanCustomerValues(rows)
 }
 
-func (s *PostgresStore) GetCustomerByID(id int) (*Customer, error) {
+const productColumns = "product_id, name, price, currency, deleted_at"
 
-	rows, err := s.db.Query("select * from customers where customer_id = $1", id)
+func (s *PostgresStore) GetProductByID(ctx context.Context, id int) (*Product, error) {
+	rows, err := s.db.QueryContext(ctx, "select "+productColumns+" from products where product_id = $1", id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("product id %d %w", id, ErrNotFound)
+	}
+
+	product, err := scanProductValues(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadProductPrices(ctx, product); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// loadProductPrices fills in the prices in other currencies of the given products with a single query
+func (s *PostgresStore) loadProductPrices(ctx context.Context, products ...*Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*Product, len(products))
+	ids := make([]string, 0, len(products))
+	for _, product := range products {
+		product.Prices = nil
+		byID[product.ProductId] = product
+		ids = append(ids, product.ProductId)
+	}
+
+	query := `select product_id, price, currency
+	from product_prices where product_id = any($1::int[]) order by product_id, currency`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
-		return scanCustomerValues(rows)
+		var productId, price, currency string
+		if err := rows.Scan(&productId, &price, &currency); err != nil {
+			return err
+		}
+
+		product, ok := byID[productId]
+		if !ok {
+			continue
+		}
+		money, err := common.ParseMoney(price, currency)
+		if err != nil {
+			return err
+		}
+		product.Prices = append(product.Prices, money)
 	}
 
-	return nil, fmt.Errorf("customer id %d not found", id)
+	return rows.Err()
 }
 
-func (s *PostgresStore) GetProductByID(id int) (*Product, error) {
-	rows, err := s.db.Query("select * from products where product_id = $1", id)
+// insertProductPrices saves the prices of the product in other currencies
+func insertProductPrices(ctx context.Context, tx *sql.Tx, product *Product) error {
+	query := `insert into product_prices 
+	(product_id, price, currency)
+	values ($1, $2, $3)`
+
+	for _, price := range product.Prices {
+		if _, err := tx.ExecContext(ctx, query, product.ProductId, price.Decimal(), price.Currency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderSortColumns maps the API sort keys to orders table columns
+var orderSortColumns = map[string]string{
+	SortByCreatedAt: "created_at",
+	SortByUpdatedAt: "updated_at",
+}
+
+func (s *PostgresStore) ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error) {
+	sortColumn, ok := orderSortColumns[filter.SortBy]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort key %s", filter.SortBy)
+	}
+
+	var conditions []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.CustomerId != "" {
+		conditions = append(conditions, "customer_id = "+arg(filter.CustomerId))
+	}
+	if filter.ProductId != "" {
+		conditions = append(conditions,
+			"exists (select 1 from order_items i where i.order_id = orders.id and i.product_id = "+arg(filter.ProductId)+")")
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status = "+arg(filter.Status))
+	}
+	if filter.CreatedFrom != nil {
+		conditions = append(conditions, "created_at >= "+arg(filter.CreatedFrom.UTC()))
+	}
+	if filter.CreatedTo != nil {
+		conditions = append(conditions, "created_at < "+arg(filter.CreatedTo.UTC()))
+	}
+
+	direction := "asc"
+	if filter.Descending {
+		direction = "desc"
+	}
+
+	// Keyset pagination on (sort column, id) keeps pages stable while orders are inserted
+	if filter.After != nil {
+		op := ">"
+		if filter.Descending {
+			op = "<"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (%s, %s)",
+			sortColumn, op, arg(filter.After.SortValue), arg(filter.After.ID)))
+	}
+
+	query := "select " + orderColumns + " from orders"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += fmt.Sprintf(" order by %s %s, id %s limit %s", sortColumn, direction, direction, arg(filter.Limit))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
+	orders := []*Order{}
 	for rows.Next() {
-		return scanProductValues(rows)
+		order, err := scanOrderValues(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadOrderItems(ctx, orders...); err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("product id %d not found", id)
+	return orders, nil
 }
 
-func (s *PostgresStore) CreateOrder(order *Order) error {
+// CreateOrder inserts the order and its line items, reserves their stock and
+// saves the outbox message and idempotency key in a single transaction
+func (s *PostgresStore) CreateOrder(ctx context.Context, order *Order, message *OutboxMessage, idempotencyKey *IdempotencyKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `insert into orders 
-	(id, customer_id, product_id, quantity, total_price, status, created_at, updated_at)
-	values ($1, $2, $3, $4, $5, $6, $7, $8)`
+	(id, customer_id, total_price, currency, status, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7)`
 
-	_, err := s.db.Query(
+	_, err = tx.ExecContext(ctx,
 		query,
 		order.ID,
 		order.CustomerId,
-		order.ProductId,
-		order.Quantity,
-		order.TotalPrice,
+		order.TotalPrice.Decimal(),
+		order.TotalPrice.Currency,
 		order.Status,
 		order.CreatedAt,
 		order.UpdatedAt)
@@ -132,78 +383,576 @@ func (s *PostgresStore) CreateOrder(order *Order) error {
 		return err
 	}
 
+	itemQuery := `insert into order_items 
+	(order_id, line_no, product_id, quantity, unit_price, subtotal)
+	values ($1, $2, $3, $4, $5, $6)`
+
+	for i, item := range order.Items {
+		_, err = tx.ExecContext(ctx,
+			itemQuery,
+			order.ID,
+			i+1,
+			item.ProductId,
+			item.Quantity,
+			item.UnitPrice.Decimal(),
+			item.Subtotal.Decimal())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := reserveInventory(ctx, tx, order); err != nil {
+		return err
+	}
+
+	if err := insertOutboxMessage(ctx, tx, message); err != nil {
+		return err
+	}
+
+	if idempotencyKey != nil {
+		if err := insertIdempotencyKey(ctx, tx, idempotencyKey); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertIdempotencyKey replaces an expired key, a live key makes the insert fail
+// and rolls the order back
+func insertIdempotencyKey(ctx context.Context, tx *sql.Tx, key *IdempotencyKey) error {
+	_, err := tx.ExecContext(ctx, "delete from idempotency_keys where key = $1 and created_at < $2",
+		key.Key, key.CreatedAt.Add(-idempotencyKeyTTL))
+	if err != nil {
+		return err
+	}
+
+	query := `insert into idempotency_keys 
+	(key, request_hash, status_code, response, created_at)
+	values ($1, $2, $3, $4, $5)`
+
+	_, err = tx.ExecContext(ctx, query, key.Key, key.RequestHash, key.StatusCode, key.Response, key.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrIdempotencyKeyExists
+	}
+	return err
+}
+
+func (s *PostgresStore) GetIdempotencyKey(ctx context.Context, key string) (*IdempotencyKey, error) {
+	query := `select key, request_hash, status_code, response, created_at
+	from idempotency_keys where key = $1 and created_at >= $2`
+
+	result := new(IdempotencyKey)
+	err := s.db.QueryRowContext(ctx, query, key, time.Now().UTC().Add(-idempotencyKeyTTL)).Scan(
+		&result.Key,
+		&result.RequestHash,
+		&result.StatusCode,
+		&result.Response,
+		&result.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("idempotency key %s %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *PostgresStore) CreateExchangeRate(ctx context.Context, rate *ExchangeRate) error {
+	query := `insert into exchange_rates 
+	(base_currency, quote_currency, rate, effective_from)
+	values ($1, $2, $3, $4)
+	on conflict (base_currency, quote_currency, effective_from) do update set rate = excluded.rate`
+
+	_, err := s.db.ExecContext(ctx, query, rate.BaseCurrency, rate.QuoteCurrency, rate.Rate, rate.EffectiveFrom)
+	return err
+}
+
+func (s *PostgresStore) GetExchangeRate(ctx context.Context, baseCurrency, quoteCurrency string, at time.Time) (*ExchangeRate, error) {
+	query := `select base_currency, quote_currency, rate, effective_from
+	from exchange_rates where base_currency = $1 and quote_currency = $2 and effective_from <= $3
+	order by effective_from desc limit 1`
+
+	result := new(ExchangeRate)
+	err := s.db.QueryRowContext(ctx, query, baseCurrency, quoteCurrency, at).Scan(
+		&result.BaseCurrency,
+		&result.QuoteCurrency,
+		&result.Rate,
+		&result.EffectiveFrom)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("exchange rate from %s to %s %w", baseCurrency, quoteCurrency, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The column keeps 10 decimal places, trailing zeros are not part of the rate
+	result.Rate = trimDecimal(result.Rate)
+	return result, nil
+}
+
+func insertOutboxMessage(ctx context.Context, tx *sql.Tx, message *OutboxMessage) error {
+	query := `insert into outbox 
+	(queue, reply_to, correlation_id, payload, created_at, next_attempt_at)
+	values ($1, $2, $3, $4, $5, $5)
+	returning id`
+
+	return tx.QueryRowContext(ctx,
+		query,
+		message.Queue,
+		message.ReplyTo,
+		message.CorrelationId,
+		message.Payload,
+		message.CreatedAt).Scan(&message.ID)
+}
+
+func (s *PostgresStore) CreateOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertOutboxMessage(ctx, tx, message); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimOutboxMessages locks due messages with skip locked so concurrent
+// OMS replicas claim disjoint batches
+func (s *PostgresStore) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	now := time.Now().UTC()
+
+	query := `UPDATE outbox SET locked_until = $1
+	WHERE id IN (
+		select id from outbox
+		where published_at is null and next_attempt_at <= $2 and (locked_until is null or locked_until < $2)
+		order by id
+		limit $3
+		for update skip locked
+	)
+	returning id, queue, reply_to, correlation_id, payload, attempts, created_at`
+
+	rows, err := s.db.QueryContext(ctx, query, now.Add(lease), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+	for rows.Next() {
+		message := new(OutboxMessage)
+		err := rows.Scan(
+			&message.ID,
+			&message.Queue,
+			&message.ReplyTo,
+			&message.CorrelationId,
+			&message.Payload,
+			&message.Attempts,
+			&message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// returning does not keep the order of the sub query
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	return messages, nil
+}
+
+func (s *PostgresStore) MarkOutboxMessagePublished(ctx context.Context, id int64) error {
+	query := "UPDATE outbox SET published_at=$1, locked_until=NULL WHERE id=$2"
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id)
+	return err
+}
+
+func (s *PostgresStore) MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, nextAttempt time.Time) error {
+	query := "UPDATE outbox SET attempts=attempts+1, last_error=$1, next_attempt_at=$2, locked_until=NULL WHERE id=$3"
+	_, err := s.db.ExecContext(ctx, query, reason, nextAttempt, id)
+	return err
+}
+
+// reserveInventory holds stock for every line item of the order. Rows are
+// locked in product id order so concurrent orders cannot deadlock.
+func reserveInventory(ctx context.Context, tx *sql.Tx, order *Order) error {
+	items := make([]OrderItem, len(order.Items))
+	copy(items, order.Items)
+	sort.Slice(items, func(i, j int) bool {
+		a, _ := strconv.Atoi(items[i].ProductId)
+		b, _ := strconv.Atoi(items[j].ProductId)
+		return a < b
+	})
+
+	for _, item := range items {
+		res, err := tx.ExecContext(ctx, `UPDATE inventory SET reserved = reserved + $1
+		WHERE product_id = $2 AND on_hand - reserved >= $1`, item.Quantity, item.ProductId)
+		if err != nil {
+			return err
+		}
+
+		reserved, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if reserved == 0 {
+			// Products created before stock was tracked have no inventory row
+			var tracked bool
+			err := tx.QueryRowContext(ctx, "select exists (select 1 from inventory where product_id = $1)", item.ProductId).Scan(&tracked)
+			if err != nil {
+				return err
+			}
+			if tracked {
+				return fmt.Errorf("product id %s: %w", item.ProductId, ErrInsufficientStock)
+			}
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into inventory_reservations 
+		(order_id, product_id, quantity, status)
+		values ($1, $2, $3, $4)`, order.ID, item.ProductId, item.Quantity, reservationReserved)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *PostgresStore) CreateProduct(product *Product) error {
+// settleInventory moves the reserved stock of an order to the given reservation status.
+// Committed stock leaves on_hand, released stock becomes available again.
+func settleInventory(ctx context.Context, tx *sql.Tx, orderId OrderID, status string) error {
+	onHandChange := "i.on_hand"
+	if status == reservationCommitted {
+		onHandChange = "i.on_hand - r.quantity"
+	}
+
+	query := `with r as (
+		UPDATE inventory_reservations SET status = $1
+		WHERE order_id = $2 AND status = $3
+		returning product_id, quantity
+	)
+	UPDATE inventory i SET reserved = i.reserved - r.quantity, on_hand = ` + onHandChange + `
+	FROM r WHERE i.product_id = r.product_id`
+
+	_, err := tx.ExecContext(ctx, query, status, orderId, reservationReserved)
+	return err
+}
+
+func (s *PostgresStore) GetInventory(ctx context.Context, productId int) (*Inventory, error) {
+	// Products created before stock was tracked have no inventory row
+	query := `select p.product_id, coalesce(i.on_hand, 0), coalesce(i.reserved, 0), i.product_id is null
+	from products p left join inventory i on i.product_id = p.product_id
+	where p.product_id = $1`
+
+	inventory := new(Inventory)
+	err := s.db.QueryRowContext(ctx, query, productId).Scan(&inventory.ProductId, &inventory.OnHand, &inventory.Reserved, &inventory.Untracked)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("product id %d %w", productId, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inventory.Available = inventory.OnHand - inventory.Reserved
+	return inventory, nil
+}
+
+// SetInventory sets the stock on hand of a product. It fails if the new
+// level is below the quantity currently reserved by pending orders.
+func (s *PostgresStore) SetInventory(ctx context.Context, productId int, onHand int64) (*Inventory, error) {
+	query := `insert into inventory (product_id, on_hand)
+	values ($1, $2)
+	on conflict (product_id) do update set on_hand = excluded.on_hand
+	where inventory.reserved <= excluded.on_hand`
+
+	res, err := s.db.ExecContext(ctx, query, productId, onHand)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRowAffected(res, fmt.Errorf("stock on hand cannot be lower than the reserved quantity")); err != nil {
+		return nil, err
+	}
+
+	return s.GetInventory(ctx, productId)
+}
+
+// CreateProduct inserts the product and sets the generated product id
+func (s *PostgresStore) CreateProduct(ctx context.Context, product *Product) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `insert into products 
-	(product_id, name, price)
-	values ($1, $2, $3)`
+	(name, price, currency)
+	values ($1, $2, $3)
+	returning product_id`
 
-	_, err := s.db.Query(
+	err = tx.QueryRowContext(ctx,
 		query,
-		product.ProductId,
 		product.Name,
-		product.Price)
+		product.Price.Decimal(),
+		product.Price.Currency).Scan(&product.ProductId)
+	if err != nil {
+		return err
+	}
+
+	if err := insertProductPrices(ctx, tx, product); err != nil {
+		return err
+	}
+
+	// New products are stock tracked and have no stock until it is set
+	if _, err := tx.ExecContext(ctx, "insert into inventory (product_id) values ($1)", product.ProductId); err != nil {
+		return err
+	}
 
+	return tx.Commit()
+}
+
+func (s *PostgresStore) ListProducts(ctx context.Context, filter ProductFilter) ([]*Product, error) {
+	query := "select " + productColumns + " from products where product_id > $1"
+	if !filter.IncludeDeleted {
+		query += " and deleted_at is null"
+	}
+	query += " order by product_id limit $2"
+
+	rows, err := s.db.QueryContext(ctx, query, filter.AfterID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []*Product{}
+	for rows.Next() {
+		product, err := scanProductValues(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadProductPrices(ctx, products...); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// UpdateProduct updates the product and replaces its prices in other currencies
+func (s *PostgresStore) UpdateProduct(ctx context.Context, product *Product) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	query := "UPDATE products SET name=$1, price=$2, currency=$3 WHERE product_id=$4 AND deleted_at IS NULL"
+	res, err := tx.ExecContext(ctx, query, product.Name, product.Price.Decimal(), product.Price.Currency, product.ProductId)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRowAffected(res, fmt.Errorf("product id %s %w", product.ProductId, ErrNotFound)); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "delete from product_prices where product_id = $1", product.ProductId); err != nil {
+		return err
+	}
+
+	if err := insertProductPrices(ctx, tx, product); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteProduct soft deletes the product by setting deleted_at
+func (s *PostgresStore) DeleteProduct(ctx context.Context, id int) error {
+	query := "UPDATE products SET deleted_at=$1 WHERE product_id=$2 AND deleted_at IS NULL"
+	res, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	return checkRowAffected(res, fmt.Errorf("product id %d %w", id, ErrNotFound))
 }
 
-func (s *PostgresStore) CreateCustomer(customer *Customer) error {
+// CreateCustomer inserts the customer and sets the generated customer id
+func (s *PostgresStore) CreateCustomer(ctx context.Context, customer *Customer) error {
 	query := `insert into customers 
-	(customer_id, name, email)
-	values ($1, $2, $3)`
+	(name, email)
+	values ($1, $2)
+	returning customer_id`
 
-	_, err := s.db.Query(
+	err := s.db.QueryRowContext(ctx,
 		query,
-		customer.CustomerId,
 		customer.Name,
-		customer.Email)
+		customer.Email).Scan(&customer.CustomerId)
+
+	return customerEmailError(err)
+}
+
+func (s *PostgresStore) ListCustomers(ctx context.Context, filter CustomerFilter) ([]*Customer, error) {
+	query := "select " + customerColumns + " from customers where customer_id > $1"
+	if !filter.IncludeDeleted {
+		query += " and deleted_at is null"
+	}
+	query += " order by customer_id limit $2"
+
+	rows, err := s.db.QueryContext(ctx, query, filter.AfterID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := []*Customer{}
+	for rows.Next() {
+		customer, err := scanCustomerValues(rows)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, customer)
+	}
+
+	return customers, rows.Err()
+}
 
+func (s *PostgresStore) UpdateCustomer(ctx context.Context, customer *Customer) error {
+	query := "UPDATE customers SET name=$1, email=$2 WHERE customer_id=$3 AND deleted_at IS NULL"
+	res, err := s.db.ExecContext(ctx, query, customer.Name, customer.Email, customer.CustomerId)
+	if err != nil {
+		return customerEmailError(err)
+	}
+
+	return checkRowAffected(res, fmt.Errorf("customer id %s %w", customer.CustomerId, ErrNotFound))
+}
+
+// DeleteCustomer soft deletes the customer, their orders are kept
+func (s *PostgresStore) DeleteCustomer(ctx context.Context, id int) error {
+	query := "UPDATE customers SET deleted_at=$1 WHERE customer_id=$2 AND deleted_at IS NULL"
+	res, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return checkRowAffected(res, fmt.Errorf("customer id %d %w", id, ErrNotFound))
+}
+
+// customerEmailError translates a violation of the unique email index
+func customerEmailError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "customers_email_key" {
+		return ErrEmailTaken
+	}
+	return err
 }
 
-func (s *PostgresStore) UpdateOrderStatus(orderId, status string) error {
-	query := "UPDATE orders SET status=$1, updated_at=$2 WHERE id=$3"
-	_, err := s.db.Exec(query, status, time.Now().UTC(), orderId)
+// UpdateOrderStatus moves the order to status only if it is still in currentStatus,
+// so concurrent updates cannot overwrite each other
+func (s *PostgresStore) UpdateOrderStatus(ctx context.Context, orderId OrderID, currentStatus, status string, message *OutboxMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE orders SET status=$1, updated_at=$2 WHERE id=$3 AND status=$4"
+	res, err := tx.ExecContext(ctx, query, status, time.Now().UTC(), orderId, currentStatus)
+	if err != nil {
+		return err
+	}
+
+	err = checkRowAffected(res, fmt.Errorf("%w: order %s is no longer %s", ErrOrderStatusChanged, orderId, currentStatus))
+	if err != nil {
+		return err
+	}
 
+	switch status {
+	case OrderCanceled:
+		err = settleInventory(ctx, tx, orderId, reservationReleased)
+	case OrderFulfilled, OrderConfirmed:
+		err = settleInventory(ctx, tx, orderId, reservationCommitted)
+	}
 	if err != nil {
 		return err
 	}
 
+	if message != nil {
+		if err := insertOutboxMessage(ctx, tx, message); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkRowAffected returns errNone when the statement did not change any row
+func checkRowAffected(res sql.Result, errNone error) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errNone
+	}
 	return nil
 }
 
+// scanOrderValues reads an order row. Prices are scanned as text and parsed
+// exactly, DECIMAL columns are never read into a float.
 func scanOrderValues(rows *sql.Rows) (*Order, error) {
 	order := new(Order)
+	var totalPrice, currency string
 	err := rows.Scan(
 		&order.ID,
 		&order.CustomerId,
-		&order.ProductId,
-		&order.Quantity,
-		&order.TotalPrice,
+		&totalPrice,
+		&currency,
 		&order.Status,
 		&order.CreatedAt,
 		&order.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
 
+	order.TotalPrice, err = common.ParseMoney(totalPrice, currency)
 	return order, err
 }
 
 func scanProductValues(rows *sql.Rows) (*Product, error) {
 	product := new(Product)
+	var price, currency string
 	err := rows.Scan(
 		&product.ProductId,
 		&product.Name,
-		&product.Price)
+		&price,
+		&currency,
+		&product.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
 
+	product.Price, err = common.ParseMoney(price, currency)
 	return product, err
 }
 
@@ -212,7 +961,8 @@ func scanCustomerValues(rows *sql.Rows) (*Customer, error) {
 	err := rows.Scan(
 		&customer.CustomerId,
 		&customer.Name,
-		&customer.Email)
+		&customer.Email,
+		&customer.DeletedAt)
 
 	return customer, err
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// newTestPostgresStore connects to the database set by the POSTGRES_* variables
+// and empties its tables. Tests using it are skipped when POSTGRES_HOST is not set.
+func newTestPostgresStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	if os.Getenv(dbHostStr) == "" {
+		t.Skip(dbHostStr + " is not set")
+	}
+
+	_, dbConfig := InitConfig()
+	store, err := NewPostgresStore(dbConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+
+	migrator, err := NewMigrator(store.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec(`truncate exchange_rates, product_prices, idempotency_keys, outbox, inventory_reservations, inventory, order_items, orders, products, customers
+	restart identity cascade`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// forEachStorage runs test against every Storage implementation so that
+// MemoryStore keeps the semantics of PostgresStore
+func forEachStorage(t *testing.T, test func(t *testing.T, store Storage)) {
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryStore()) })
+	t.Run("postgres", func(t *testing.T) { test(t, newTestPostgresStore(t)) })
+}
+
+// seedStorage stores a customer and a product with 5 units in stock
+func seedStorage(t *testing.T, store Storage) (*Customer, *Product) {
+	t.Helper()
+	ctx := context.Background()
+	customer := NewCustomer("Jane", "jane@example.com")
+	if err := store.CreateCustomer(ctx, customer); err != nil {
+		t.Fatal(err)
+	}
+	product := NewProduct("Mug", usd("10"), nil)
+	if err := store.CreateProduct(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	productId, _ := strconv.Atoi(product.ProductId)
+	if _, err := store.SetInventory(ctx, productId, 5); err != nil {
+		t.Fatal(err)
+	}
+	return customer, product
+}
+
+// newTestOrder returns a pending order of quantity units of product
+func newTestOrder(t *testing.T, id OrderID, customer *Customer, product *Product, quantity int64) *Order {
+	t.Helper()
+	item, err := NewOrderItem(product.ProductId, quantity, product.Price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := NewOrder(id, customer.CustomerId, []OrderItem{item})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func testOutboxMessage() *OutboxMessage {
+	return NewOutboxMessage("processingorders", "paymentstatus", "", []byte("{}"))
+}
+
+func TestStorageReservesStock(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		status       string
+		wantOnHand   int64
+		wantReserved int64
+	}{
+		// Canceled orders give their stock back
+		{status: OrderCanceled, wantOnHand: 5, wantReserved: 0},
+		// Confirmed orders take their stock out of on hand
+		{status: OrderConfirmed, wantOnHand: 2, wantReserved: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			forEachStorage(t, func(t *testing.T, store Storage) {
+				customer, product := seedStorage(t, store)
+				ids := newTestIDs(t)
+				productId, _ := strconv.Atoi(product.ProductId)
+
+				order := newTestOrder(t, nextTestID(t, ids), customer, product, 3)
+				if err := store.CreateOrder(ctx, order, testOutboxMessage(), nil); err != nil {
+					t.Fatal(err)
+				}
+				checkInventory(t, store, productId, 5, 3)
+
+				// The rejected order is not stored and reserves nothing
+				rejected := newTestOrder(t, nextTestID(t, ids), customer, product, 3)
+				if err := store.CreateOrder(ctx, rejected, testOutboxMessage(), nil); !errors.Is(err, ErrInsufficientStock) {
+					t.Fatalf("CreateOrder() beyond the available stock = %v, want ErrInsufficientStock", err)
+				}
+				if _, err := store.GetOrderByID(ctx, rejected.ID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("GetOrderByID() of the rejected order = %v, want ErrNotFound", err)
+				}
+				checkInventory(t, store, productId, 5, 3)
+
+				if _, err := store.SetInventory(ctx, productId, 2); err == nil {
+					t.Error("SetInventory() below the reserved quantity succeeded")
+				}
+
+				if err := store.UpdateOrderStatus(ctx, order.ID, OrderPending, tt.status, nil); err != nil {
+					t.Fatal(err)
+				}
+				checkInventory(t, store, productId, tt.wantOnHand, tt.wantReserved)
+
+				// The stock is settled only once
+				if tt.status == OrderConfirmed {
+					if err := store.UpdateOrderStatus(ctx, order.ID, OrderConfirmed, OrderRefunding, nil); err != nil {
+						t.Fatal(err)
+					}
+					checkInventory(t, store, productId, tt.wantOnHand, tt.wantReserved)
+				}
+			})
+		})
+	}
+}
+
+func checkInventory(t *testing.T, store Storage, productId int, onHand, reserved int64) {
+	t.Helper()
+	ctx := context.Background()
+	inventory, err := store.GetInventory(ctx, productId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory.OnHand != onHand || inventory.Reserved != reserved || inventory.Available != onHand-reserved {
+		t.Errorf("inventory = %+v, want %d on hand and %d reserved", inventory, onHand, reserved)
+	}
+}
+
+func TestStorageUpdateOrderStatus(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		customer, product := seedStorage(t, store)
+		ids := newTestIDs(t)
+		order := newTestOrder(t, nextTestID(t, ids), customer, product, 1)
+		if err := store.CreateOrder(ctx, order, testOutboxMessage(), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// The update only applies while the order still has the expected status
+		tests := []struct {
+			orderId    OrderID
+			current    string
+			status     string
+			wantErr    error
+			wantStatus string
+		}{
+			{orderId: order.ID, current: OrderConfirmed, status: OrderRefunding, wantErr: ErrOrderStatusChanged, wantStatus: OrderPending},
+			{orderId: order.ID + 1, current: OrderPending, status: OrderConfirmed, wantErr: ErrOrderStatusChanged, wantStatus: OrderPending},
+			{orderId: order.ID, current: OrderPending, status: OrderConfirmed, wantStatus: OrderConfirmed},
+			{orderId: order.ID, current: OrderPending, status: OrderCanceled, wantErr: ErrOrderStatusChanged, wantStatus: OrderConfirmed},
+		}
+
+		for _, tt := range tests {
+			err := store.UpdateOrderStatus(ctx, tt.orderId, tt.current, tt.status, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("UpdateOrderStatus(%s, %s, %s) = %v, want %v", tt.orderId, tt.current, tt.status, err, tt.wantErr)
+			}
+
+			stored, err := store.GetOrderByID(ctx, order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.wantStatus {
+				t.Errorf("order is %s after UpdateOrderStatus(%s, %s, %s), want %s", stored.Status, tt.orderId, tt.current, tt.status, tt.wantStatus)
+			}
+		}
+	})
+}
+
+func TestStorageSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		customer, product := seedStorage(t, store)
+		customerId, _ := strconv.Atoi(customer.CustomerId)
+		productId, _ := strconv.Atoi(product.ProductId)
+
+		if err := store.DeleteProduct(ctx, productId); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteCustomer(ctx, customerId); err != nil {
+			t.Fatal(err)
+		}
+
+		// Deleted rows are still found so that orders keep resolving
+		if got, err := store.GetProductByID(ctx, productId); err != nil || got.DeletedAt == nil {
+			t.Errorf("GetProductByID() of a deleted product = %+v, %v", got, err)
+		}
+		if got, err := store.GetCustomerByID(ctx, customerId); err != nil || got.DeletedAt == nil {
+			t.Errorf("GetCustomerByID() of a deleted customer = %+v, %v", got, err)
+		}
+
+		for name, err := range map[string]error{
+			"DeleteProduct":  store.DeleteProduct(ctx, productId),
+			"DeleteCustomer": store.DeleteCustomer(ctx, customerId),
+			"UpdateProduct":  store.UpdateProduct(ctx, product),
+			"UpdateCustomer": store.UpdateCustomer(ctx, customer),
+		} {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s() of a deleted row = %v, want ErrNotFound", name, err)
+			}
+		}
+
+		products, err := store.ListProducts(ctx, ProductFilter{Limit: 10})
+		if err != nil || len(products) != 0 {
+			t.Errorf("ListProducts() = %v, %v, want no products", products, err)
+		}
+		products, err = store.ListProducts(ctx, ProductFilter{IncludeDeleted: true, Limit: 10})
+		if err != nil || len(products) != 1 {
+			t.Errorf("ListProducts() with deleted products = %v, %v, want the deleted product", products, err)
+		}
+
+		customers, err := store.ListCustomers(ctx, CustomerFilter{Limit: 10})
+		if err != nil || len(customers) != 0 {
+			t.Errorf("ListCustomers() = %v, %v, want no customers", customers, err)
+		}
+
+		// The email of a deleted customer can be used again, ignoring case
+		if err := store.CreateCustomer(ctx, NewCustomer("Jane", "JANE@example.com")); err != nil {
+			t.Fatalf("CreateCustomer() with the email of a deleted customer failed: %v", err)
+		}
+		if err := store.CreateCustomer(ctx, NewCustomer("Jane", "jane@example.com")); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("CreateCustomer() with a used email = %v, want ErrEmailTaken", err)
+		}
+
+		if _, err := store.GetCustomerByID(ctx, customerId+10); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetCustomerByID() of an unknown customer = %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetProductByID(ctx, productId+10); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetProductByID() of an unknown product = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStorageListOrders(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		customer, product := seedStorage(t, store)
+
+		// Orders 2 and 3 are created at the same time so ties are broken by id
+		created := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+		for i, offset := range []int{0, 1, 1, 2} {
+			order := newTestOrder(t, OrderID(i+1), customer, product, 1)
+			order.CreatedAt = created.Add(time.Duration(offset) * time.Minute)
+			order.UpdatedAt = created.Add(time.Duration(10-i) * time.Minute)
+			if err := store.CreateOrder(ctx, order, testOutboxMessage(), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.UpdateOrderStatus(ctx, 4, OrderPending, OrderCanceled, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			filter OrderFilter
+			want   []OrderID
+		}{
+			{name: "created", filter: OrderFilter{SortBy: SortByCreatedAt}, want: []OrderID{1, 2, 3, 4}},
+			{name: "created descending", filter: OrderFilter{SortBy: SortByCreatedAt, Descending: true}, want: []OrderID{4, 3, 2, 1}},
+			{name: "updated", filter: OrderFilter{SortBy: SortByUpdatedAt}, want: []OrderID{3, 2, 1, 4}},
+			{name: "status", filter: OrderFilter{SortBy: SortByCreatedAt, Status: OrderPending}, want: []OrderID{1, 2, 3}},
+			{name: "limit", filter: OrderFilter{SortBy: SortByCreatedAt, Limit: 2}, want: []OrderID{1, 2}},
+			{
+				name:   "after tie",
+				filter: OrderFilter{SortBy: SortByCreatedAt, After: &OrderCursor{SortBy: SortByCreatedAt, SortValue: created.Add(time.Minute), ID: 2}},
+				want:   []OrderID{3, 4},
+			},
+			{
+				name:   "after tie descending",
+				filter: OrderFilter{SortBy: SortByCreatedAt, Descending: true, After: &OrderCursor{SortBy: SortByCreatedAt, Descending: true, SortValue: created.Add(time.Minute), ID: 3}},
+				want:   []OrderID{2, 1},
+			},
+			{
+				name:   "created range",
+				filter: OrderFilter{SortBy: SortByCreatedAt, CreatedFrom: timePtr(created.Add(time.Minute)), CreatedTo: timePtr(created.Add(2 * time.Minute))},
+				want:   []OrderID{2, 3},
+			},
+			{name: "product", filter: OrderFilter{SortBy: SortByCreatedAt, ProductId: product.ProductId, Limit: 1}, want: []OrderID{1}},
+			{name: "other customer", filter: OrderFilter{SortBy: SortByCreatedAt, CustomerId: customer.CustomerId + "0"}, want: nil},
+		}
+
+		for _, tt := range tests {
+			filter := tt.filter
+			if filter.Limit == 0 {
+				filter.Limit = 10
+			}
+			orders, err := store.ListOrders(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []OrderID
+			for _, order := range orders {
+				ids = append(ids, order.ID)
+				if len(order.Items) != 1 {
+					t.Errorf("%s: order %s has %d items, want 1", tt.name, order.ID, len(order.Items))
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("%s: ListOrders() = %v, want %v", tt.name, ids, tt.want)
+			}
+		}
+	})
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestStorageOutbox(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		customer, product := seedStorage(t, store)
+		ids := newTestIDs(t)
+
+		order := newTestOrder(t, nextTestID(t, ids), customer, product, 1)
+		if err := store.CreateOrder(ctx, order, NewOutboxMessage("processingorders", "paymentstatus", "create", []byte("{}")), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateOrderStatus(ctx, order.ID, OrderPending, OrderConfirmed, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateOrderStatus(ctx, order.ID, OrderConfirmed, OrderRefunding, NewOutboxMessage("processingorders", "paymentstatus", "refund", []byte("{}"))); err != nil {
+			t.Fatal(err)
+		}
+
+		// The message of a rejected status update is not saved
+		err := store.UpdateOrderStatus(ctx, order.ID, OrderConfirmed, OrderRefunding, NewOutboxMessage("processingorders", "paymentstatus", "late", []byte("{}")))
+		if !errors.Is(err, ErrOrderStatusChanged) {
+			t.Fatalf("UpdateOrderStatus() from a stale status = %v, want ErrOrderStatusChanged", err)
+		}
+
+		claim := func(limit int) []*OutboxMessage {
+			t.Helper()
+			messages, err := store.ClaimOutboxMessages(ctx, limit, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return messages
+		}
+
+		create := claim(1)
+		if len(create) != 1 || create[0].CorrelationId != "create" {
+			t.Fatalf("claimed %+v first, want the create message", create)
+		}
+
+		// Claimed messages are hidden until published or failed
+		refund := claim(10)
+		if len(refund) != 1 || refund[0].CorrelationId != "refund" {
+			t.Fatalf("claimed %+v next, want the refund message", refund)
+		}
+		if again := claim(10); len(again) != 0 {
+			t.Errorf("claimed %+v again while leased", again)
+		}
+
+		if err := store.MarkOutboxMessagePublished(ctx, create[0].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// A failed message is claimed again once due, the published one never is
+		if err := store.MarkOutboxMessageFailed(ctx, refund[0].ID, "broker down", time.Now().UTC().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		retried := claim(10)
+		if len(retried) != 1 || retried[0].CorrelationId != "refund" || retried[0].Attempts != 1 {
+			t.Errorf("claimed %+v after a failure, want the refund message attempted once", retried)
+		}
+	})
+}
+
+func TestStorageIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		customer, product := seedStorage(t, store)
+		ids := newTestIDs(t)
+		newOrder := func() *Order {
+			return newTestOrder(t, nextTestID(t, ids), customer, product, 1)
+		}
+
+		if _, err := store.GetIdempotencyKey(ctx, "order-1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetIdempotencyKey() of an unused key = %v, want ErrNotFound", err)
+		}
+
+		key := NewIdempotencyKey("order-1", "hash")
+		key.StatusCode = 201
+		key.Response = []byte(`{"id":"1"}`)
+		if err := store.CreateOrder(ctx, newOrder(), testOutboxMessage(), key); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := store.GetIdempotencyKey(ctx, "order-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.RequestHash != "hash" || stored.StatusCode != 201 || string(stored.Response) != `{"id":"1"}` {
+			t.Errorf("GetIdempotencyKey() = %+v, want the saved key", stored)
+		}
+
+		// The order of a second request with the key is not saved
+		duplicate := newOrder()
+		if err := store.CreateOrder(ctx, duplicate, testOutboxMessage(), NewIdempotencyKey("order-1", "hash")); !errors.Is(err, ErrIdempotencyKeyExists) {
+			t.Fatalf("CreateOrder() with a used key = %v, want ErrIdempotencyKeyExists", err)
+		}
+		if _, err := store.GetOrderByID(ctx, duplicate.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetOrderByID() of the duplicate order = %v, want ErrNotFound", err)
+		}
+
+		// Expired keys can be used again
+		expired := NewIdempotencyKey("order-2", "old")
+		expired.CreatedAt = expired.CreatedAt.Add(-idempotencyKeyTTL - time.Minute)
+		if err := store.CreateOrder(ctx, newOrder(), testOutboxMessage(), expired); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetIdempotencyKey(ctx, "order-2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetIdempotencyKey() of an expired key = %v, want ErrNotFound", err)
+		}
+		if err := store.CreateOrder(ctx, newOrder(), testOutboxMessage(), NewIdempotencyKey("order-2", "new")); err != nil {
+			t.Errorf("CreateOrder() with an expired key failed: %v", err)
+		}
+	})
+}
+
+func TestStorageExchangeRates(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		day := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+		for _, rate := range []*ExchangeRate{
+			NewExchangeRate("USD", "EUR", "0.9", day),
+			NewExchangeRate("USD", "EUR", "0.95", day.Add(24*time.Hour)),
+			NewExchangeRate("EUR", "USD", "1.1", day),
+			// Replaces the rate of the first day
+			NewExchangeRate("USD", "EUR", "0.92", day),
+		} {
+			if err := store.CreateExchangeRate(ctx, rate); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			base, quote string
+			at          time.Time
+			want        string
+		}{
+			{base: "USD", quote: "EUR", at: day, want: "0.92"},
+			{base: "USD", quote: "EUR", at: day.Add(23 * time.Hour), want: "0.92"},
+			{base: "USD", quote: "EUR", at: day.Add(48 * time.Hour), want: "0.95"},
+			{base: "EUR", quote: "USD", at: day, want: "1.1"},
+			{base: "USD", quote: "EUR", at: day.Add(-time.Second)},
+			{base: "USD", quote: "JPY", at: day},
+		}
+
+		for _, tt := range tests {
+			rate, err := store.GetExchangeRate(ctx, tt.base, tt.quote, tt.at)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("GetExchangeRate(%s, %s, %v) = %+v, %v, want ErrNotFound", tt.base, tt.quote, tt.at, rate, err)
+				}
+				continue
+			}
+			if err != nil || rate.Rate != tt.want {
+				t.Errorf("GetExchangeRate(%s, %s, %v) = %+v, %v, want rate %s", tt.base, tt.quote, tt.at, rate, err, tt.want)
+			}
+		}
+	})
+}
+
+func TestStorageProductPrices(t *testing.T) {
+	ctx := context.Background()
+	forEachStorage(t, func(t *testing.T, store Storage) {
+		product := NewProduct("Mug", usd("10"), []common.Money{common.MustParseMoney("9", "EUR")})
+		if err := store.CreateProduct(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+		productId, _ := strconv.Atoi(product.ProductId)
+
+		product.Prices = []common.Money{common.MustParseMoney("1500", "JPY")}
+		if err := store.UpdateProduct(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+
+		// The prices are replaced, not merged
+		stored, err := store.GetProductByID(ctx, productId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Price != usd("10") || !reflect.DeepEqual(stored.Prices, product.Prices) {
+			t.Errorf("GetProductByID() = %v %v, want %v %v", stored.Price, stored.Prices, usd("10"), product.Prices)
+		}
+	})
+}
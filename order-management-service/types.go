@@ -1,72 +1,360 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
 	"time"
+
+	"github.com/aayush993/go-order-management/common"
 )
 
 const (
-	OrderPending   = "Pending"
-	OrderConfirmed = "Confirmed"
-	OrderCanceled  = "Canceled"
+	OrderPending    = "Pending"
+	OrderAuthorized = "Authorized"
+	OrderCapturing  = "Capturing"
+	OrderFulfilled  = "Fulfilled"
+	OrderVoiding    = "Voiding"
+	OrderConfirmed  = "Confirmed"
+	OrderCanceled   = "Canceled"
+	OrderRefunding  = "Refunding"
+	OrderRefunded   = "Refunded"
+)
+
+var (
+	// ErrNotFound is wrapped by storage lookups that find no matching row
+	ErrNotFound = errors.New("not found")
+
+	// ErrProductRetired is returned when a soft deleted product is ordered or modified
+	ErrProductRetired = errors.New("product is retired")
+
+	// ErrInsufficientStock is returned when an order asks for more than the available stock
+	ErrInsufficientStock = errors.New("insufficient stock")
+
+	// ErrIdempotencyKeyExists is returned when an order was already created with the idempotency key
+	ErrIdempotencyKeyExists = errors.New("idempotency key already used")
+
+	// ErrIdempotencyKeyReused is returned when an idempotency key is sent again with a different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used with a different request")
+
+	// ErrInvalidPaymentStatus is returned for payment responses with an unknown status
+	ErrInvalidPaymentStatus = errors.New("invalid payment status")
+
+	// ErrEmailTaken is returned when another active customer already uses the email
+	ErrEmailTaken = errors.New("email already in use")
+
+	// ErrNoExchangeRate is returned when a product has no price in the order currency
+	// and no exchange rate from its base currency is in effect
+	ErrNoExchangeRate = errors.New("no exchange rate")
+)
+
+// Status of the stock reserved for an order line
+const (
+	reservationReserved  = "reserved"
+	reservationReleased  = "released"
+	reservationCommitted = "committed"
+)
+
+// Sort keys accepted when listing orders
+const (
+	SortByCreatedAt = "createdAt"
+	SortByUpdatedAt = "updatedAt"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+
+	// Idempotency keys are kept this long, after that the key can be used for a new request
+	idempotencyKeyTTL       = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+
+	// Limits of the varchar(100) and DECIMAL(10, 2) columns, prices must be
+	// below maxPriceUnits units of their currency
+	maxNameLength = 100
+	maxPriceUnits = 100_000_000
+
+	// Limits of the DECIMAL(20, 10) exchange rate column
+	maxRateDecimals = 10
+	maxRateUnits    = 10_000_000_000
 )
 
 type Order struct {
-	ID         string    `json:"id"`
-	CustomerId string    `json:"customerId"`
-	ProductId  string    `json:"productId"`
-	Quantity   int64     `json:"quantity"`
-	TotalPrice float64   `json:"totalPrice"`
-	Status     string    `json:"status"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
+	ID         OrderID      `json:"id"`
+	CustomerId string       `json:"customerId"`
+	Items      []OrderItem  `json:"items"`
+	TotalPrice common.Money `json:"totalPrice"`
+	Status     string       `json:"status"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	UpdatedAt  time.Time    `json:"updatedAt"`
+}
+
+// OrderItem is a single line of an order. UnitPrice is a snapshot of the
+// product price when the order was placed.
+type OrderItem struct {
+	ProductId string       `json:"productId"`
+	Quantity  int64        `json:"quantity"`
+	UnitPrice common.Money `json:"unitPrice"`
+	Subtotal  common.Money `json:"subtotal"`
+}
+
+// OrderItemRequest is a product and quantity requested by the customer
+type OrderItemRequest struct {
+	ProductId string `json:"productId"`
+	Quantity  int64  `json:"quantity"`
 }
 
 type Customer struct {
-	CustomerId string `json:"customerId"`
-	Name       string `json:"name"`
-	Email      string `json:"email"`
+	CustomerId string     `json:"customerId"`
+	Name       string     `json:"name"`
+	Email      string     `json:"email"`
+	DeletedAt  *time.Time `json:"deletedAt,omitempty"`
+}
+
+// CustomerFilter holds the criteria used to list customers
+type CustomerFilter struct {
+	IncludeDeleted bool
+	Limit          int
+	Cursor         string
+
+	// AfterID is the decoded Cursor, set by the service before querying storage
+	AfterID int
+}
+
+// CustomerPage is a single page of customers returned by the list API
+type CustomerPage struct {
+	Customers  []*Customer `json:"customers"`
+	NextCursor string      `json:"nextCursor,omitempty"`
 }
 
 type Product struct {
-	ProductId string  `json:"productId"`
-	Name      string  `json:"name"`
-	Price     float64 `json:"email"`
+	ProductId string       `json:"productId"`
+	Name      string       `json:"name"`
+	Price     common.Money `json:"price"`
+
+	// Prices are the prices in currencies other than the currency of Price.
+	// Orders in other currencies convert Price with the current exchange rate.
+	Prices    []common.Money `json:"prices,omitempty"`
+	DeletedAt *time.Time     `json:"deletedAt,omitempty"`
+}
+
+// ExchangeRate is the price of one unit of BaseCurrency in QuoteCurrency. It is used for
+// orders created from EffectiveFrom until the next rate of the currency pair takes effect.
+type ExchangeRate struct {
+	BaseCurrency  string    `json:"baseCurrency"`
+	QuoteCurrency string    `json:"quoteCurrency"`
+	Rate          string    `json:"rate"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+}
+
+// OutboxMessage is a message saved in the same transaction as the change
+// that produced it, and published to the broker by the OutboxRelay
+type OutboxMessage struct {
+	ID            int64
+	Queue         string
+	ReplyTo       string
+	CorrelationId string
+	Payload       []byte
+	Attempts      int
+	CreatedAt     time.Time
+}
+
+// IdempotencyKey records the response of a request sent with an Idempotency-Key
+// header so that retries of the same request get the same response
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// Inventory is the stock level of a product. Reserved units are held by
+// pending orders and are not available to new orders. Products created
+// before stock was tracked are Untracked until their stock is set, orders
+// for them are not limited by stock.
+type Inventory struct {
+	ProductId string `json:"productId"`
+	OnHand    int64  `json:"onHand"`
+	Reserved  int64  `json:"reserved"`
+	Available int64  `json:"available"`
+	Untracked bool   `json:"untracked,omitempty"`
+}
+
+// ProductFilter holds the criteria used to list products
+type ProductFilter struct {
+	IncludeDeleted bool
+	Limit          int
+	Cursor         string
+
+	// AfterID is the decoded Cursor, set by the service before querying storage
+	AfterID int
+}
+
+// IDCursor marks the position of the last row of a page ordered by id
+type IDCursor struct {
+	ID int `json:"i"`
+}
+
+// ProductPage is a single page of products returned by the list API
+type ProductPage struct {
+	Products   []*Product `json:"products"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// OrderFilter holds the criteria used to list orders
+type OrderFilter struct {
+	CustomerId  string
+	ProductId   string
+	Status      string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	SortBy      string
+	Descending  bool
+	Limit       int
+	Cursor      string
+
+	// After is the decoded Cursor, set by the service before querying storage
+	After *OrderCursor
+}
+
+// OrderCursor marks the position of the last order of a page
+type OrderCursor struct {
+	SortBy     string    `json:"s"`
+	Descending bool      `json:"d"`
+	SortValue  time.Time `json:"v"`
+	ID         OrderID   `json:"i"`
 }
 
-func NewOrder(customerId, productId string, quantity int64, productPrice float64) *Order {
+// OrderPage is a single page of orders returned by the list API
+type OrderPage struct {
+	Orders     []*Order `json:"orders"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// NewOrder creates a pending order, its total is the exact sum of the item subtotals
+func NewOrder(id OrderID, customerId string, items []OrderItem) (*Order, error) {
+	total, err := calculateOrderTotal(items)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Order{
-		ID:         generateNumber(),
+		ID:         id,
 		CustomerId: customerId,
-		ProductId:  productId,
-		Quantity:   quantity,
-		TotalPrice: calculateTotalPrice(quantity, productPrice),
+		Items:      items,
+		TotalPrice: total,
 		CreatedAt:  time.Now().UTC(),
 		UpdatedAt:  time.Now().UTC(),
 		Status:     OrderPending,
+	}, nil
+}
+
+func NewIdempotencyKey(key, requestHash string) *IdempotencyKey {
+	return &IdempotencyKey{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   time.Now().UTC(),
 	}
 }
 
-func NewProduct(productName string, price float64) *Product {
+func NewOutboxMessage(queue, replyTo, correlationId string, payload []byte) *OutboxMessage {
+	return &OutboxMessage{
+		Queue:         queue,
+		ReplyTo:       replyTo,
+		CorrelationId: correlationId,
+		Payload:       payload,
+		CreatedAt:     time.Now().UTC(),
+	}
+}
+
+// NewProduct creates a product without an ID, storage assigns one on insert
+func NewProduct(productName string, price common.Money, prices []common.Money) *Product {
 	return &Product{
-		ProductId: "1", // Can generate random ID for more entries in future
-		Name:      productName,
-		Price:     price,
+		Name:   productName,
+		Price:  price,
+		Prices: prices,
 	}
 }
 
+func NewExchangeRate(baseCurrency, quoteCurrency, rate string, effectiveFrom time.Time) *ExchangeRate {
+	return &ExchangeRate{
+		BaseCurrency:  baseCurrency,
+		QuoteCurrency: quoteCurrency,
+		Rate:          rate,
+		EffectiveFrom: effectiveFrom.UTC(),
+	}
+}
+
+// NewCustomer creates a customer without an ID, storage assigns one on insert
 func NewCustomer(customerName, email string) *Customer {
 	return &Customer{
-		CustomerId: "1", // Can generate random ID for more entries in future
-		Name:       customerName,
-		Email:      email,
+		Name:  customerName,
+		Email: email,
+	}
+}
+
+func NewOrderItem(productId string, quantity int64, unitPrice common.Money) (OrderItem, error) {
+	subtotal, err := unitPrice.Mul(quantity)
+	if err != nil {
+		return OrderItem{}, err
+	}
+
+	return OrderItem{
+		ProductId: productId,
+		Quantity:  quantity,
+		UnitPrice: unitPrice,
+		Subtotal:  subtotal,
+	}, nil
+}
+
+// calculateOrderTotal adds up the subtotals, which must all be in the same currency
+func calculateOrderTotal(items []OrderItem) (common.Money, error) {
+	if len(items) == 0 {
+		return common.Money{}, fmt.Errorf("order must contain at least one item")
+	}
+
+	total := common.Money{Currency: items[0].Subtotal.Currency}
+	for _, item := range items {
+		var err error
+		if total, err = total.Add(item.Subtotal); err != nil {
+			return common.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+func newOrderCursor(order *Order, sortBy string, descending bool) *OrderCursor {
+	cursor := &OrderCursor{
+		SortBy:     sortBy,
+		Descending: descending,
+		SortValue:  order.CreatedAt,
+		ID:         order.ID,
+	}
+	if sortBy == SortByUpdatedAt {
+		cursor.SortValue = order.UpdatedAt
 	}
+	return cursor
 }
-func generateNumber() string {
-	return fmt.Sprintf("%06d", rand.Intn(1000000))
+
+// encodeCursor serializes a cursor into an opaque url safe token
+func encodeCursor(cursor any) (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func calculateTotalPrice(quantity int64, productPrice float64) float64 {
-	return float64(quantity) * productPrice
+func decodeCursor(token string, cursor any) error {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+
+	if err := json.Unmarshal(b, cursor); err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	return nil
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+func TestOrderCursorRoundTrip(t *testing.T) {
+	created := time.Date(2024, 5, 13, 19, 52, 41, 487668000, time.UTC)
+	updated := created.Add(time.Hour)
+	order := &Order{ID: 712882, CreatedAt: created, UpdatedAt: updated}
+
+	tests := []struct {
+		sortBy     string
+		descending bool
+		wantValue  time.Time
+	}{
+		{SortByCreatedAt, false, created},
+		{SortByCreatedAt, true, created},
+		{SortByUpdatedAt, false, updated},
+		{SortByUpdatedAt, true, updated},
+	}
+
+	for _, tt := range tests {
+		token, err := encodeCursor(newOrderCursor(order, tt.sortBy, tt.descending))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := new(OrderCursor)
+		if err := decodeCursor(token, got); err != nil {
+			t.Fatalf("decodeCursor(%s) failed: %v", token, err)
+		}
+		want := OrderCursor{SortBy: tt.sortBy, Descending: tt.descending, SortValue: tt.wantValue, ID: order.ID}
+		if *got != want {
+			t.Errorf("cursor sorted by %s descending %v = %+v, want %+v", tt.sortBy, tt.descending, *got, want)
+		}
+	}
+}
+
+func TestDecodeOrderCursorInvalid(t *testing.T) {
+	for _, token := range []string{
+		"not base64!",
+		"bm90IGpzb24",             // "not json"
+		"eyJzIjoxfQ",              // {"s":1}
+		"eyJ2IjoieWVzdGVyZGF5In0", // {"v":"yesterday"}
+	} {
+		if err := decodeCursor(token, new(OrderCursor)); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded, want an error", token)
+		}
+	}
+}
+
+// usd returns the amount in the default currency
+func usd(amount string) common.Money {
+	return common.MustParseMoney(amount, common.DefaultCurrency)
+}
+
+func TestNewOrderTotal(t *testing.T) {
+	tests := []struct {
+		name    string
+		prices  []common.Money
+		want    common.Money
+		wantErr bool
+	}{
+		{name: "single item", prices: []common.Money{usd("10")}, want: usd("20")},
+		{name: "exact cents", prices: []common.Money{usd("0.10"), usd("0.20")}, want: usd("0.60")},
+		{name: "mixed currencies", prices: []common.Money{usd("10"), common.MustParseMoney("10", "EUR")}, wantErr: true},
+		{name: "no items", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		// Every line is two units of its price
+		var items []OrderItem
+		for i, price := range tt.prices {
+			item, err := NewOrderItem(strconv.Itoa(i+1), 2, price)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items = append(items, item)
+		}
+
+		order, err := NewOrder(1, "1", items)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: NewOrder() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if order.TotalPrice != tt.want {
+			t.Errorf("%s: total = %v, want %v", tt.name, order.TotalPrice, tt.want)
+		}
+		if order.Status != OrderPending {
+			t.Errorf("%s: new order is %s, want %s", tt.name, order.Status, OrderPending)
+		}
+	}
+}
+
+func TestIDCursorRoundTrip(t *testing.T) {
+	for _, id := range []int{1, 42, 1 << 40} {
+		token, err := encodeCursor(&IDCursor{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := new(IDCursor)
+		if err := decodeCursor(token, got); err != nil {
+			t.Fatalf("decodeCursor(%s) failed: %v", token, err)
+		}
+		if got.ID != id {
+			t.Errorf("cursor of %d = %d", id, got.ID)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aayush993/go-order-management/common"
+	"github.com/aayush993/go-order-management/payment-processing-service/payments"
+	"github.com/gorilla/mux"
+)
+
+// idempotencyKeyHeader lets clients retry a top-up without adding it twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	maxIdempotencyKeyLength = 128
+	maxCustomerIdLength     = 64
+)
+
+// APIServer serves the balances of the ledger
+type APIServer struct {
+	port   string
+	ledger payments.Ledger
+}
+
+func NewAPIServer(port string, ledger payments.Ledger) *APIServer {
+	return &APIServer{
+		port:   port,
+		ledger: ledger,
+	}
+}
+
+// Run serves the API until ctx is canceled, then stops accepting connections
+// and waits for in-flight requests
+func (s *APIServer) Run(ctx context.Context) error {
+	router := mux.NewRouter()
+	router.HandleFunc("/customers/{id}/balance", makeHTTPHandleFunc(s.HandleBalanceRetrieve)).Methods("GET")
+	router.HandleFunc("/customers/{id}/top-ups", makeHTTPHandleFunc(s.HandleTopUp)).Methods("POST")
+
+	listenAddr := ":" + s.port
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: router,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("[x] Server now listening on port: ", listenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to drain HTTP requests: %v", err)
+	}
+	return nil
+}
+
+// BalanceResponse is the balance of a customer in every currency it had one.
+// Held amounts are authorized for orders and not part of the balance.
+type BalanceResponse struct {
+	CustomerID string         `json:"customerId"`
+	Balances   []common.Money `json:"balances"`
+	Held       []common.Money `json:"held"`
+}
+
+// HandleBalanceRetrieve handles the retrieval of the balance of a customer
+func (s *APIServer) HandleBalanceRetrieve(w http.ResponseWriter, r *http.Request) error {
+	customerId, err := getCustomerID(r)
+	if err != nil {
+		return err
+	}
+
+	balances, err := s.ledger.Balances(r.Context(), customerId)
+	if err != nil {
+		return err
+	}
+
+	held, err := s.ledger.Holds(r.Context(), customerId)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSONResponse(w, http.StatusOK, BalanceResponse{CustomerID: customerId, Balances: balances, Held: held})
+}
+
+// HandleTopUp handles adding money to the balance of a customer. The body is
+// the amount, such as {"amount": "100.00", "currency": "EUR"}. The Idempotency-Key
+// header is required, so a retried top-up is never added twice.
+func (s *APIServer) HandleTopUp(w http.ResponseWriter, r *http.Request) error {
+	customerId, err := getCustomerID(r)
+	if err != nil {
+		return err
+	}
+
+	var amount common.Money
+	if err := json.NewDecoder(r.Body).Decode(&amount); err != nil {
+		return err
+	}
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("%s header is required, with at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+
+	t, err := s.ledger.TopUp(r.Context(), customerId, amount, key)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Topped up %s for customer id: %s", amount, customerId)
+	return WriteJSONResponse(w, http.StatusCreated, t)
+}
+
+type apiFunc func(http.ResponseWriter, *http.Request) error
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := f(w, r); err != nil {
+			WriteJSONResponse(w, errorStatusCode(err), ApiError{Error: err.Error()})
+		}
+	}
+}
+
+// errorStatusCode maps ledger errors to HTTP status codes
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, payments.ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func WriteJSONResponse(w http.ResponseWriter, status int, v any) error {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+func getCustomerID(r *http.Request) (string, error) {
+	id := mux.Vars(r)["id"]
+	if id == "" || len(id) > maxCustomerIdLength {
+		return "", fmt.Errorf("invalid customer id %q", id)
+	}
+	return id, nil
+}
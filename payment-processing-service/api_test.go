@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aayush993/go-order-management/payment-processing-service/payments"
+	"github.com/gorilla/mux"
+)
+
+func TestHandleTopUp(t *testing.T) {
+	server := NewAPIServer("", payments.NewMemoryLedger())
+
+	// Requests are sent in order to the same ledger
+	tests := []struct {
+		name     string
+		key      string
+		body     string
+		wantCode int
+	}{
+		{name: "without key", body: `{"amount": "10", "currency": "USD"}`, wantCode: http.StatusBadRequest},
+		{name: "key too long", key: strings.Repeat("k", maxIdempotencyKeyLength+1), body: `{"amount": "10", "currency": "USD"}`, wantCode: http.StatusBadRequest},
+		{name: "topped up", key: "a", body: `{"amount": "10", "currency": "USD"}`, wantCode: http.StatusCreated},
+		{name: "sent again", key: "a", body: `{"amount": "10", "currency": "USD"}`, wantCode: http.StatusCreated},
+		{name: "key reused", key: "a", body: `{"amount": "20", "currency": "USD"}`, wantCode: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/customers/1/top-ups", strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		if tt.key != "" {
+			req.Header.Set(idempotencyKeyHeader, tt.key)
+		}
+
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.HandleTopUp)(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: top-up = %d %s, want %d", tt.name, rec.Code, rec.Body, tt.wantCode)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/customers/1/balance", nil), map[string]string{"id": "1"})
+	makeHTTPHandleFunc(server.HandleBalanceRetrieve)(rec, req)
+	if !strings.Contains(rec.Body.String(), `"10.00"`) {
+		t.Errorf("balance after top-ups = %s, want 10.00 USD", rec.Body)
+	}
+}
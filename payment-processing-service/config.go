@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aayush993/go-order-management/common"
+	"github.com/aayush993/go-order-management/payment-processing-service/payments"
+)
+
+// Values of PAYMENT_PROCESSOR
+const (
+	processorApprove   = "approve"
+	processorThreshold = "threshold"
+	processorRandom    = "random"
+	processorBalance   = "balance"
+	processorScripted  = "scripted"
+)
+
+func InitDbConfig() *payments.DbConfig {
+	return &payments.DbConfig{
+		StorageType: os.Getenv(storageTypeStr),
+		User:        os.Getenv(pgUserStr),
+		Password:    os.Getenv(pgPassStr),
+		Name:        os.Getenv(pgDbStr),
+		Host:        os.Getenv(dbHostStr),
+	}
+}
+
+// intFromEnv reads an optional non negative number from the environment
+func intFromEnv(key string) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid value of %s: %s", key, value)
+	}
+	return n
+}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+// NewPaymentProcessorFromEnv returns the processor selected by PAYMENT_PROCESSOR, balance by default
+func NewPaymentProcessorFromEnv(ledger payments.Ledger) (payments.PaymentProcessor, error) {
+	switch kind := os.Getenv(paymentProcessorStr); kind {
+	case processorApprove:
+		return payments.ApproveProcessor{}, nil
+
+	case processorThreshold:
+		limits, err := parsePaymentLimits(envOrDefault(paymentLimitsStr, defaultPaymentLimits))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", paymentLimitsStr, err)
+		}
+		return payments.NewThresholdProcessor(limits), nil
+
+	case processorRandom:
+		rate, err := strconv.ParseFloat(envOrDefault(paymentFailureRateStr, defaultFailureRate), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid %s, expected a number between 0 and 1", paymentFailureRateStr)
+		}
+		return payments.NewRandomProcessor(rate, rand.Int63()), nil
+
+	case "", processorBalance:
+		return payments.NewLedgerProcessor(ledger), nil
+
+	case processorScripted:
+		path := os.Getenv(paymentScriptStr)
+		if path == "" {
+			return nil, fmt.Errorf("%s is required by the scripted payment processor", paymentScriptStr)
+		}
+		processor, err := payments.LoadScriptedProcessor(path)
+		if err != nil {
+			return nil, err
+		}
+		return processor, nil
+
+	default:
+		return nil, fmt.Errorf("unknown payment processor %s", kind)
+	}
+}
+
+// parsePaymentLimits reads the largest approved payment per currency, such as USD:1000,EUR:900
+func parsePaymentLimits(value string) (map[string]common.Money, error) {
+	limits := make(map[string]common.Money)
+	for _, entry := range strings.Split(value, ",") {
+		currency, amount, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("expected currency:amount, got %s", entry)
+		}
+
+		limit, err := common.ParseMoney(amount, currency)
+		if err != nil {
+			return nil, err
+		}
+		limits[currency] = limit
+	}
+	return limits, nil
+}
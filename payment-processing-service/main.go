@@ -1,20 +1,57 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aayush993/go-order-management/common"
-	"github.com/streadway/amqp"
+	"github.com/aayush993/go-order-management/payment-processing-service/payments"
 )
 
 // All constants
 const (
-	amqpUrlStr           = "AMQP_SERVER_URL"
-	receiveRoutingKeyStr = "RECEIVE_ROUTING_KEY"
+	amqpUrlStr            = "AMQP_SERVER_URL"
+	exchangeNameStr       = "EXCHANGE_NAME"
+	exchangeTypeStr       = "EXCHANGE_TYPE"
+	receiveRoutingKeyStr  = "RECEIVE_ROUTING_KEY"
+	consumerWorkersStr    = "CONSUMER_WORKERS"
+	consumerPrefetchStr   = "CONSUMER_PREFETCH"
+	paymentProcessorStr   = "PAYMENT_PROCESSOR"
+	paymentLimitsStr      = "PAYMENT_LIMITS"
+	paymentFailureRateStr = "PAYMENT_FAILURE_RATE"
+	paymentBalancesStr    = "PAYMENT_BALANCES"
+	paymentScriptStr      = "PAYMENT_SCRIPT"
+	portStr               = "PORT"
+	storageTypeStr        = "STORAGE_TYPE"
+	pgUserStr             = "POSTGRES_USER"
+	pgPassStr             = "POSTGRES_PASSWORD"
+	pgDbStr               = "POSTGRES_DB"
+	dbHostStr             = "POSTGRES_HOST"
 )
 
+// Supported values of STORAGE_TYPE
+const (
+	storagePostgres = "postgres"
+	storageMemory   = "memory"
+)
+
+// Defaults of the payment processor settings
+const (
+	defaultPaymentLimits = "USD:1000"
+	defaultFailureRate   = "0.1"
+	defaultPort          = "3001"
+)
+
+// shutdownTimeout bounds the time taken to stop once a signal is received
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 
 	// Get config from environment
@@ -22,57 +59,135 @@ func main() {
 	ordersQueueName := os.Getenv(receiveRoutingKeyStr)
 
 	// Initialize rabbitMQ Client Service
-	rabbitmqService, err := common.NewRabbitMQService(amqpServerURL)
+	exchange, err := common.NewExchange(os.Getenv(exchangeNameStr), os.Getenv(exchangeTypeStr))
+	if err != nil {
+		log.Fatalf("Failed to initialize RabbitMQ service: %v", err)
+	}
+	rabbitmqService, err := common.NewRabbitMQService(amqpServerURL, exchange)
 	if err != nil {
 		log.Fatalf("Failed to initialize RabbitMQ service: %v", err)
 	}
 	defer rabbitmqService.Close()
 
 	log.Printf("Checking orders in queue to process payments...")
-	err = rabbitmqService.Consume(ordersQueueName, func(msgs <-chan amqp.Delivery) {
-		for d := range msgs {
-
-			var req common.PaymentRequest
-			requesId := d.CorrelationId
-
-			err := json.Unmarshal(d.Body, &req)
-			if err != nil {
-				log.Printf("[%s] Failed to decode message error: %v", requesId, err)
-				continue
-			}
-
-			// Simulate payment processing
-			var res common.PaymentResponse
-			res.OrderID = req.OrderID
-
-			var message string
-			if req.TotalPrice <= 1000 {
-				message = "Payment successful"
-				res.PaymentStatus = common.PaymentSuccessfull
-			} else {
-				res.PaymentStatus = common.PaymentFailed
-				message = "Payment failed: Insufficient funds"
-			}
-
-			log.Printf("[%s] %s for order id: %v", requesId, message, req.OrderID)
-
-			// Publish payment response
-			body, err := json.Marshal(res)
-			if err != nil {
-				log.Printf("[%s] failed to marshal json: %v", requesId, err)
-			}
-
-			err = rabbitmqService.Publish(d.ReplyTo, body, "", requesId)
-			if err != nil {
-				log.Printf("[%s] Failed to publish payment response: %v", requesId, err)
-			}
-
-			d.Ack(false)
-			log.Printf("[%s] Payment response published", requesId)
-		}
-	})
+	opts := common.ConsumeOptions{
+		Workers:  intFromEnv(consumerWorkersStr),
+		Prefetch: intFromEnv(consumerPrefetchStr),
+		Key:      common.OrderKey,
+	}
+	log.Printf("Processing payments with %d workers", max(opts.Workers, 1))
+
+	ledger := initLedger(InitDbConfig())
+	defer ledger.Close()
+
+	if err := openBalances(context.Background(), ledger, os.Getenv(paymentBalancesStr)); err != nil {
+		log.Fatalf("Invalid %s: %v", paymentBalancesStr, err)
+	}
+
+	processor, err := NewPaymentProcessorFromEnv(ledger)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Failed to initialize payment processor: %v", err)
+	}
+	log.Printf("Deciding payments with the %T", processor)
+
+	// Stop on SIGTERM from the container runtime or Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	consumerDone := make(chan error, 1)
+	go func() {
+		consumerDone <- rabbitmqService.Consume(ctx, ordersQueueName, opts, payments.PaymentsWorker(rabbitmqService, ordersQueueName, processor))
+	}()
+
+	// Serve the balances of the ledger
+	server := NewAPIServer(envOrDefault(portStr, defaultPort), ledger)
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		if err := server.Run(ctx); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	select {
+	case err := <-consumerDone:
+		if err != nil {
+			log.Fatal(err)
+		}
+	case <-ctx.Done():
+		// Consume returns once the requests being processed are acked
+		log.Printf("Shutting down, waiting up to %v", shutdownTimeout)
+		deadline := time.After(shutdownTimeout)
+		select {
+		case <-consumerDone:
+		case <-deadline:
+			log.Printf("Payment requests still being processed at the shutdown deadline")
+		}
+
+		// The server stops accepting connections and waits for in-flight requests
+		select {
+		case <-serverDone:
+		case <-deadline:
+		}
 	}
 
+	// The ledger and the message broker connection are closed by the deferred Close
+	log.Printf("[x] Payment processing stopped")
+}
+
+func initLedger(dbConfig *payments.DbConfig) payments.Ledger {
+	switch dbConfig.StorageType {
+	case storageMemory:
+		log.Printf("[x] Using in-memory ledger, balances will not be persisted")
+		return payments.NewMemoryLedger()
+
+	case "", storagePostgres:
+		ledger, err := payments.NewPostgresLedger(dbConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		log.Printf("[x] Database connected")
+
+		migrator, err := ledger.NewMigrator()
+		if err != nil {
+			log.Fatalf("Failed to load migrations: %v", err)
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		return ledger
+
+	default:
+		log.Fatalf("Unknown storage type: %s", dbConfig.StorageType)
+		return nil
+	}
+}
+
+// openBalances tops up the starting balances of customers, such as 1:USD:500,1:EUR:100,2:USD:50.
+// Every balance is added once, restarts with the same setting do not add it again.
+func openBalances(ctx context.Context, ledger payments.Ledger, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("expected customer:currency:amount, got %s", entry)
+		}
+
+		amount, err := common.ParseMoney(parts[2], parts[1])
+		if err != nil {
+			return err
+		}
+		_, err = ledger.TopUp(ctx, parts[0], amount, "opening-balance:"+parts[1])
+		if errors.Is(err, payments.ErrIdempotencyKeyReused) {
+			log.Printf("Opening balance of customer id: %s in %s was already added with another amount", parts[0], parts[1])
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,561 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aayush993/go-order-management/common"
+	_ "github.com/lib/pq"
+)
+
+// Migrations of the ledger tables, recorded in payment_schema_migrations so the
+// ledger can share a database with the order management service
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the postgres advisory lock held while migrating the ledger
+const migrationLockID = 5_301_774_019
+
+var (
+	// ErrInsufficientFunds is returned when a payment is larger than the balance of the customer
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// ErrInvalidAmount is returned for top-ups and payments that are not positive
+	ErrInvalidAmount = errors.New("amount must be greater than 0")
+
+	// ErrIdempotencyKeyReused is returned when a top-up key was used with a different amount
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used with a different top-up")
+
+	// ErrNoAuthorization is returned when capturing or voiding an order without a hold
+	ErrNoAuthorization = errors.New("no authorization")
+
+	// ErrAuthorizationSettled is returned when capturing a voided hold or voiding a captured one
+	ErrAuthorizationSettled = errors.New("authorization was already settled")
+
+	// ErrNoPayment is returned when refunding an order that was not paid through the ledger
+	ErrNoPayment = errors.New("no payment")
+
+	// ErrNoCapture is returned when refunding an order whose hold was not captured
+	ErrNoCapture = errors.New("no captured payment")
+)
+
+// Kinds of ledger transactions
+const (
+	transactionTopUp         = "topup"
+	transactionAuthorization = "authorization"
+	transactionCapture       = "capture"
+	transactionVoid          = "void"
+	transactionRefund        = "refund"
+
+	// transactionPayment debited orders in a single step before authorizations,
+	// these payments are still refunded
+	transactionPayment = "payment"
+)
+
+// Accounts of the ledger. Customer accounts hold the available balances of
+// customers and holds accounts the amounts authorized for their orders, they
+// cannot go below zero. The other accounts are their counterparts.
+const (
+	// fundingAccount is where top-ups come from, its balance is minus the money paid in
+	fundingAccount = "funding"
+
+	// paymentsAccount receives the captured payments of orders and pays their refunds
+	paymentsAccount = "payments"
+
+	customerAccountPrefix = "customer:"
+	holdsAccountPrefix    = "holds:"
+)
+
+func customerAccount(customerId string) string {
+	return customerAccountPrefix + customerId
+}
+
+func holdsAccount(customerId string) string {
+	return holdsAccountPrefix + customerId
+}
+
+// nonNegative reports whether the balance of account cannot go below zero
+func nonNegative(account string) bool {
+	return strings.HasPrefix(account, customerAccountPrefix) || strings.HasPrefix(account, holdsAccountPrefix)
+}
+
+// Entry is the change of the balance of one account, credits are positive and debits negative
+type Entry struct {
+	Account string       `json:"account"`
+	Amount  common.Money `json:"amount"`
+}
+
+// Transaction is a double-entry movement of money, its entries sum to zero.
+// The id makes posting a transaction idempotent: top-ups are identified by the
+// customer and a key chosen by the client, authorizations and refunds by their
+// order. The capture and the void of an order share an id, so a hold is settled once.
+type Transaction struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	CustomerID string    `json:"customerId"`
+	OrderID    string    `json:"orderId,omitempty"`
+	Entries    []Entry   `json:"entries"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func newTopUp(customerId string, amount common.Money, key string) *Transaction {
+	return &Transaction{
+		ID:         transactionTopUp + ":" + customerId + ":" + key,
+		Kind:       transactionTopUp,
+		CustomerID: customerId,
+		Entries: []Entry{
+			{Account: fundingAccount, Amount: negate(amount)},
+			{Account: customerAccount(customerId), Amount: amount},
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func authorizationID(orderId string) string {
+	return transactionAuthorization + ":" + orderId
+}
+
+// newAuthorization moves the amount of the order from the balance of the customer to its holds
+func newAuthorization(customerId, orderId string, amount common.Money) *Transaction {
+	return &Transaction{
+		ID:         authorizationID(orderId),
+		Kind:       transactionAuthorization,
+		CustomerID: customerId,
+		OrderID:    orderId,
+		Entries: []Entry{
+			{Account: customerAccount(customerId), Amount: negate(amount)},
+			{Account: holdsAccount(customerId), Amount: amount},
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func settlementID(orderId string) string {
+	return "settlement:" + orderId
+}
+
+// newSettlement releases the hold placed by authorization, to the payments account
+// for captures and back to the balance of the customer for voids
+func newSettlement(kind string, authorization *Transaction) *Transaction {
+	amount := negate(authorization.customerAmount())
+	to := paymentsAccount
+	if kind == transactionVoid {
+		to = customerAccount(authorization.CustomerID)
+	}
+
+	return &Transaction{
+		ID:         settlementID(authorization.OrderID),
+		Kind:       kind,
+		CustomerID: authorization.CustomerID,
+		OrderID:    authorization.OrderID,
+		Entries: []Entry{
+			{Account: holdsAccount(authorization.CustomerID), Amount: negate(amount)},
+			{Account: to, Amount: amount},
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func paymentID(orderId string) string {
+	return transactionPayment + ":" + orderId
+}
+
+// newRefund returns the payment taken by paid, a capture or a single step payment,
+// from the payments account to the balance of the customer
+func newRefund(paid *Transaction) *Transaction {
+	amount := paid.accountAmount(paymentsAccount)
+	return &Transaction{
+		ID:         transactionRefund + ":" + paid.OrderID,
+		Kind:       transactionRefund,
+		CustomerID: paid.CustomerID,
+		OrderID:    paid.OrderID,
+		Entries: []Entry{
+			{Account: paymentsAccount, Amount: negate(amount)},
+			{Account: customerAccount(paid.CustomerID), Amount: amount},
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// checkRefundable returns ErrNoCapture when the hold of the order was voided
+func checkRefundable(paid *Transaction) error {
+	if paid.Kind == transactionVoid {
+		return fmt.Errorf("%w: order %s was settled with a %s", ErrNoCapture, paid.OrderID, paid.Kind)
+	}
+	return nil
+}
+
+// checkReplayedSettlement returns ErrAuthorizationSettled when the order was settled with another kind
+func checkReplayedSettlement(t *Transaction, kind string) error {
+	if t.Kind != kind {
+		return fmt.Errorf("%w: order %s was settled with a %s", ErrAuthorizationSettled, t.OrderID, t.Kind)
+	}
+	return nil
+}
+
+func negate(m common.Money) common.Money {
+	return common.Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// customerAmount is the amount of the transaction credited to the available
+// balance of the customer, negative for authorizations
+func (t *Transaction) customerAmount() common.Money {
+	return t.accountAmount(customerAccount(t.CustomerID))
+}
+
+// accountAmount is the amount of the transaction credited to account
+func (t *Transaction) accountAmount(account string) common.Money {
+	for _, e := range t.Entries {
+		if e.Account == account {
+			return e.Amount
+		}
+	}
+	return common.Money{}
+}
+
+// Ledger keeps the balances of customers as double-entry transactions
+type Ledger interface {
+	// TopUp adds amount to the balance of the customer. A top-up sent again with the
+	// same key is applied once and returns the first transaction.
+	TopUp(ctx context.Context, customerId string, amount common.Money, key string) (*Transaction, error)
+
+	// Authorize places a hold on the payment of an order, taken from the balance of the
+	// customer. It returns ErrInsufficientFunds when the balance in the currency of the
+	// payment does not cover it. An order is authorized once, authorizing it again returns
+	// the first transaction.
+	Authorize(ctx context.Context, customerId, orderId string, amount common.Money) (*Transaction, error)
+
+	// Capture takes the held payment of an order, and Void returns it to the balance of the
+	// customer. They return ErrNoAuthorization for orders without a hold, and
+	// ErrAuthorizationSettled when the hold was settled the other way. Settling a hold again
+	// the same way returns the first transaction.
+	Capture(ctx context.Context, orderId string) (*Transaction, error)
+	Void(ctx context.Context, orderId string) (*Transaction, error)
+
+	// Refund returns the captured payment of an order to the balance of the customer, or
+	// the payment of an order paid in a single step before authorizations. It returns
+	// ErrNoCapture for orders whose hold was not captured and ErrNoPayment for orders
+	// that were not paid through the ledger. An order is refunded once, refunding it again returns
+	// the first transaction.
+	Refund(ctx context.Context, orderId string) (*Transaction, error)
+
+	// Balances returns the available balance of the customer in every currency it had one, by currency
+	Balances(ctx context.Context, customerId string) ([]common.Money, error)
+
+	// Holds returns the amounts held for authorized orders of the customer, by currency
+	Holds(ctx context.Context, customerId string) ([]common.Money, error)
+
+	// Close releases the connections of the ledger
+	Close() error
+}
+
+func validateAmount(amount common.Money) error {
+	if amount.Amount <= 0 {
+		return fmt.Errorf("%w, got %s", ErrInvalidAmount, amount)
+	}
+	if !common.ValidCurrency(amount.Currency) {
+		return fmt.Errorf("%w %q", common.ErrUnknownCurrency, amount.Currency)
+	}
+	return nil
+}
+
+func validateTopUp(customerId string, amount common.Money, key string) error {
+	if customerId == "" {
+		return fmt.Errorf("customer id is required")
+	}
+	if key == "" {
+		return fmt.Errorf("top-up key is required")
+	}
+	return validateAmount(amount)
+}
+
+func validateAuthorization(customerId, orderId string, amount common.Money) error {
+	if customerId == "" {
+		return fmt.Errorf("customer id is required")
+	}
+	if orderId == "" {
+		return fmt.Errorf("order id is required")
+	}
+	return validateAmount(amount)
+}
+
+// checkReplayedTopUp returns ErrIdempotencyKeyReused when the stored top-up is not for amount
+func checkReplayedTopUp(t *Transaction, amount common.Money) error {
+	if t.Kind != transactionTopUp || t.customerAmount() != amount {
+		return fmt.Errorf("%w: %s", ErrIdempotencyKeyReused, t.ID)
+	}
+	return nil
+}
+
+// DbConfig holds the connection settings of the ledger database
+type DbConfig struct {
+	StorageType string
+	User        string
+	Password    string
+	Name        string
+	Host        string
+}
+
+type PostgresLedger struct {
+	db *sql.DB
+}
+
+func NewPostgresLedger(config *DbConfig) (*PostgresLedger, error) {
+	connStr := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable host=%s", config.User, config.Password, config.Name, config.Host)
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &PostgresLedger{
+		db: db,
+	}, nil
+}
+
+// NewMigrator returns the migrator of the ledger tables
+func (l *PostgresLedger) NewMigrator() (*common.Migrator, error) {
+	return common.NewMigrator(l.db, migrationFiles, "migrations", "payment_schema_migrations", migrationLockID)
+}
+
+func (l *PostgresLedger) Close() error {
+	return l.db.Close()
+}
+
+func (l *PostgresLedger) TopUp(ctx context.Context, customerId string, amount common.Money, key string) (*Transaction, error) {
+	if err := validateTopUp(customerId, amount, key); err != nil {
+		return nil, err
+	}
+
+	t, replayed, err := l.post(ctx, newTopUp(customerId, amount, key))
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		if err := checkReplayedTopUp(t, amount); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (l *PostgresLedger) Authorize(ctx context.Context, customerId, orderId string, amount common.Money) (*Transaction, error) {
+	if err := validateAuthorization(customerId, orderId, amount); err != nil {
+		return nil, err
+	}
+
+	t, _, err := l.post(ctx, newAuthorization(customerId, orderId, amount))
+	return t, err
+}
+
+func (l *PostgresLedger) Capture(ctx context.Context, orderId string) (*Transaction, error) {
+	return l.settle(ctx, transactionCapture, orderId)
+}
+
+func (l *PostgresLedger) Void(ctx context.Context, orderId string) (*Transaction, error) {
+	return l.settle(ctx, transactionVoid, orderId)
+}
+
+func (l *PostgresLedger) settle(ctx context.Context, kind, orderId string) (*Transaction, error) {
+	authorization, err := l.getTransaction(ctx, authorizationID(orderId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w for order %s", ErrNoAuthorization, orderId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t, replayed, err := l.post(ctx, newSettlement(kind, authorization))
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		if err := checkReplayedSettlement(t, kind); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (l *PostgresLedger) Refund(ctx context.Context, orderId string) (*Transaction, error) {
+	paid, err := l.getTransaction(ctx, settlementID(orderId))
+	if err == nil {
+		err = checkRefundable(paid)
+	} else if errors.Is(err, sql.ErrNoRows) {
+		paid, err = l.getTransaction(ctx, paymentID(orderId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, l.checkAuthorized(ctx, orderId)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t, _, err := l.post(ctx, newRefund(paid))
+	return t, err
+}
+
+// checkAuthorized returns the error of refunding an order without a payment,
+// ErrNoCapture when its payment is still held
+func (l *PostgresLedger) checkAuthorized(ctx context.Context, orderId string) error {
+	_, err := l.getTransaction(ctx, authorizationID(orderId))
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: order %s was not captured", ErrNoCapture, orderId)
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w for order %s", ErrNoPayment, orderId)
+	}
+	return err
+}
+
+// post saves the transaction and applies its entries to the balances atomically. A transaction
+// with the same id that was already posted is returned instead, with replayed set.
+func (l *PostgresLedger) post(ctx context.Context, t *Transaction) (*Transaction, bool, error) {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// A concurrent post of the same id waits here until the first one commits or rolls back
+	query := `insert into ledger_transactions (id, kind, customer_id, order_id, created_at)
+	values ($1, $2, $3, $4, $5) on conflict (id) do nothing`
+
+	res, err := tx.ExecContext(ctx, query, t.ID, t.Kind, t.CustomerID, sql.NullString{String: t.OrderID, Valid: t.OrderID != ""}, t.CreatedAt)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if n == 0 {
+		tx.Rollback()
+		existing, err := l.getTransaction(ctx, t.ID)
+		return existing, true, err
+	}
+
+	// Balance rows are locked in account order, so transactions moving money between
+	// the same accounts in opposite directions, like an authorization and a void, cannot deadlock
+	locked := append([]Entry(nil), t.Entries...)
+	sort.Slice(locked, func(i, j int) bool {
+		if locked[i].Account != locked[j].Account {
+			return locked[i].Account < locked[j].Account
+		}
+		return locked[i].Amount.Currency < locked[j].Amount.Currency
+	})
+	for _, e := range locked {
+		if err := applyEntry(ctx, tx, e); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, e := range t.Entries {
+		_, err := tx.ExecContext(ctx, "insert into ledger_entries (transaction_id, account, amount, currency) values ($1, $2, $3, $4)",
+			t.ID, e.Account, e.Amount.Decimal(), e.Amount.Currency)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return t, false, nil
+}
+
+// applyEntry adds the entry to the balance of its account. The balance row is locked
+// until the transaction ends, so payments of one customer are applied one at a time.
+func applyEntry(ctx context.Context, tx *sql.Tx, e Entry) error {
+	if e.Amount.Amount < 0 && nonNegative(e.Account) {
+		query := `update ledger_balances set balance = balance + $3
+		where account = $1 and currency = $2 and balance + $3 >= 0`
+
+		res, err := tx.ExecContext(ctx, query, e.Account, e.Amount.Currency, e.Amount.Decimal())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: %s of %s", ErrInsufficientFunds, e.Amount.Currency, e.Account)
+		}
+		return nil
+	}
+
+	query := `insert into ledger_balances (account, currency, balance) values ($1, $2, $3)
+	on conflict (account, currency) do update set balance = ledger_balances.balance + excluded.balance`
+
+	_, err := tx.ExecContext(ctx, query, e.Account, e.Amount.Currency, e.Amount.Decimal())
+	return err
+}
+
+func (l *PostgresLedger) getTransaction(ctx context.Context, id string) (*Transaction, error) {
+	var (
+		t       Transaction
+		orderId sql.NullString
+	)
+	err := l.db.QueryRowContext(ctx, "select id, kind, customer_id, order_id, created_at from ledger_transactions where id = $1", id).
+		Scan(&t.ID, &t.Kind, &t.CustomerID, &orderId, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.OrderID = orderId.String
+
+	rows, err := l.db.QueryContext(ctx, "select account, amount, currency from ledger_entries where transaction_id = $1 order by id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Entry
+		var amount, currency string
+		if err := rows.Scan(&e.Account, &amount, &currency); err != nil {
+			return nil, err
+		}
+		if e.Amount, err = common.ParseMoney(amount, currency); err != nil {
+			return nil, err
+		}
+		t.Entries = append(t.Entries, e)
+	}
+	return &t, rows.Err()
+}
+
+func (l *PostgresLedger) Balances(ctx context.Context, customerId string) ([]common.Money, error) {
+	return l.accountBalances(ctx, customerAccount(customerId))
+}
+
+func (l *PostgresLedger) Holds(ctx context.Context, customerId string) ([]common.Money, error) {
+	return l.accountBalances(ctx, holdsAccount(customerId))
+}
+
+func (l *PostgresLedger) accountBalances(ctx context.Context, account string) ([]common.Money, error) {
+	rows, err := l.db.QueryContext(ctx, "select balance, currency from ledger_balances where account = $1 order by currency", account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []common.Money{}
+	for rows.Next() {
+		var amount, currency string
+		if err := rows.Scan(&amount, &currency); err != nil {
+			return nil, err
+		}
+		balance, err := common.ParseMoney(amount, currency)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+	return balances, rows.Err()
+}
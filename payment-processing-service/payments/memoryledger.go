@@ -0,0 +1,175 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// MemoryLedger keeps the transactions and balances of the ledger in maps. A
+// single lock covers a whole transaction, so its entries are applied together
+// and balances that must stay non-negative are checked before any changes.
+// Posting the same transaction id again returns the stored transaction, as
+// PostgresLedger does. Used with STORAGE_TYPE=memory, the money is gone on exit.
+type MemoryLedger struct {
+	mu sync.Mutex
+
+	transactions map[string]*Transaction
+	balances     map[string]map[string]common.Money
+}
+
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{
+		transactions: make(map[string]*Transaction),
+		balances:     make(map[string]map[string]common.Money),
+	}
+}
+
+func (l *MemoryLedger) Close() error {
+	return nil
+}
+
+func (l *MemoryLedger) TopUp(ctx context.Context, customerId string, amount common.Money, key string) (*Transaction, error) {
+	if err := validateTopUp(customerId, amount, key); err != nil {
+		return nil, err
+	}
+
+	t, replayed, err := l.post(newTopUp(customerId, amount, key))
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		if err := checkReplayedTopUp(t, amount); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (l *MemoryLedger) Authorize(ctx context.Context, customerId, orderId string, amount common.Money) (*Transaction, error) {
+	if err := validateAuthorization(customerId, orderId, amount); err != nil {
+		return nil, err
+	}
+
+	t, _, err := l.post(newAuthorization(customerId, orderId, amount))
+	return t, err
+}
+
+func (l *MemoryLedger) Capture(ctx context.Context, orderId string) (*Transaction, error) {
+	return l.settle(transactionCapture, orderId)
+}
+
+func (l *MemoryLedger) Void(ctx context.Context, orderId string) (*Transaction, error) {
+	return l.settle(transactionVoid, orderId)
+}
+
+func (l *MemoryLedger) settle(kind, orderId string) (*Transaction, error) {
+	l.mu.Lock()
+	authorization, ok := l.transactions[authorizationID(orderId)]
+	l.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w for order %s", ErrNoAuthorization, orderId)
+	}
+
+	t, replayed, err := l.post(newSettlement(kind, authorization))
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		if err := checkReplayedSettlement(t, kind); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (l *MemoryLedger) Refund(ctx context.Context, orderId string) (*Transaction, error) {
+	l.mu.Lock()
+	paid, ok := l.transactions[settlementID(orderId)]
+	if !ok {
+		paid, ok = l.transactions[paymentID(orderId)]
+	}
+	_, authorized := l.transactions[authorizationID(orderId)]
+	l.mu.Unlock()
+	if !ok && authorized {
+		return nil, fmt.Errorf("%w: order %s was not captured", ErrNoCapture, orderId)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w for order %s", ErrNoPayment, orderId)
+	}
+	if err := checkRefundable(paid); err != nil {
+		return nil, err
+	}
+
+	t, _, err := l.post(newRefund(paid))
+	return t, err
+}
+
+func (l *MemoryLedger) post(t *Transaction) (*Transaction, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if existing, ok := l.transactions[t.ID]; ok {
+		return copyTransaction(existing), true, nil
+	}
+
+	// Compute every new balance before changing any, so a failed transaction leaves no changes
+	updated := make([]common.Money, len(t.Entries))
+	for i, e := range t.Entries {
+		balance, ok := l.balances[e.Account][e.Amount.Currency]
+		if !ok {
+			balance = common.Money{Currency: e.Amount.Currency}
+		}
+
+		sum, err := balance.Add(e.Amount)
+		if err != nil {
+			return nil, false, err
+		}
+		if sum.Amount < 0 && e.Amount.Amount < 0 && nonNegative(e.Account) {
+			return nil, false, fmt.Errorf("%w: %s of %s", ErrInsufficientFunds, e.Amount.Currency, e.Account)
+		}
+		updated[i] = sum
+	}
+
+	for i, e := range t.Entries {
+		if l.balances[e.Account] == nil {
+			l.balances[e.Account] = make(map[string]common.Money)
+		}
+		l.balances[e.Account][e.Amount.Currency] = updated[i]
+	}
+
+	l.transactions[t.ID] = copyTransaction(t)
+	return t, false, nil
+}
+
+func (l *MemoryLedger) Balances(ctx context.Context, customerId string) ([]common.Money, error) {
+	return l.accountBalances(customerAccount(customerId)), nil
+}
+
+func (l *MemoryLedger) Holds(ctx context.Context, customerId string) ([]common.Money, error) {
+	return l.accountBalances(holdsAccount(customerId)), nil
+}
+
+func (l *MemoryLedger) accountBalances(account string) []common.Money {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	balances := []common.Money{}
+	for _, balance := range l.balances[account] {
+		balances = append(balances, balance)
+	}
+
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Currency < balances[j].Currency
+	})
+	return balances
+}
+
+func copyTransaction(t *Transaction) *Transaction {
+	c := *t
+	c.Entries = append([]Entry(nil), t.Entries...)
+	return &c
+}
@@ -0,0 +1,225 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// ledgerStep is an operation on the ledger of customer 1
+type ledgerStep struct {
+	op      string
+	order   string
+	amount  string
+	key     string
+	wantErr error
+}
+
+func (s ledgerStep) apply(ctx context.Context, l Ledger) error {
+	switch s.op {
+	case "topup":
+		_, err := l.TopUp(ctx, "1", common.MustParseMoney(s.amount, "USD"), s.key)
+		return err
+	case "authorize":
+		_, err := l.Authorize(ctx, "1", s.order, common.MustParseMoney(s.amount, "USD"))
+		return err
+	case "capture":
+		_, err := l.Capture(ctx, s.order)
+		return err
+	case "void":
+		_, err := l.Void(ctx, s.order)
+		return err
+	case "refund":
+		_, err := l.Refund(ctx, s.order)
+		return err
+	case "pay":
+		// Orders were paid in a single step before authorizations
+		_, _, err := l.(*MemoryLedger).post(legacyPayment("1", s.order, common.MustParseMoney(s.amount, "USD")))
+		return err
+	}
+	return errors.New("unknown ledger operation " + s.op)
+}
+
+func TestMemoryLedger(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []ledgerStep
+		wantBalance string
+		wantHolds   string
+	}{
+		{
+			name: "top-up",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "topup", amount: "25.5", key: "b"},
+			},
+			wantBalance: "75.50 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "top-up sent again",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "topup", amount: "50", key: "a"},
+				{op: "topup", amount: "60", key: "a", wantErr: ErrIdempotencyKeyReused},
+			},
+			wantBalance: "50.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "invalid top-up",
+			steps: []ledgerStep{
+				{op: "topup", amount: "0", key: "a", wantErr: ErrInvalidAmount},
+				{op: "topup", amount: "-5", key: "b", wantErr: ErrInvalidAmount},
+			},
+			wantBalance: "0.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "authorized",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "authorize", order: "7", amount: "20"},
+				{op: "authorize", order: "7", amount: "20"},
+			},
+			wantBalance: "30.00 USD",
+			wantHolds:   "20.00 USD",
+		},
+		{
+			name: "insufficient funds",
+			steps: []ledgerStep{
+				{op: "topup", amount: "10", key: "a"},
+				{op: "authorize", order: "7", amount: "20", wantErr: ErrInsufficientFunds},
+			},
+			wantBalance: "10.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "captured",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "authorize", order: "7", amount: "20"},
+				{op: "capture", order: "7"},
+				{op: "capture", order: "7"},
+				{op: "void", order: "7", wantErr: ErrAuthorizationSettled},
+			},
+			wantBalance: "30.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "voided",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "authorize", order: "7", amount: "20"},
+				{op: "void", order: "7"},
+				{op: "void", order: "7"},
+				{op: "capture", order: "7", wantErr: ErrAuthorizationSettled},
+			},
+			wantBalance: "50.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "settled without an authorization",
+			steps: []ledgerStep{
+				{op: "capture", order: "7", wantErr: ErrNoAuthorization},
+				{op: "void", order: "7", wantErr: ErrNoAuthorization},
+			},
+			wantBalance: "0.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "refunded",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "authorize", order: "7", amount: "20"},
+				{op: "capture", order: "7"},
+				{op: "refund", order: "7"},
+				{op: "refund", order: "7"},
+			},
+			wantBalance: "50.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "refunded without a capture",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "authorize", order: "7", amount: "20"},
+				{op: "refund", order: "7", wantErr: ErrNoCapture},
+				{op: "void", order: "7"},
+				{op: "refund", order: "7", wantErr: ErrNoCapture},
+			},
+			wantBalance: "50.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "refunded without a payment",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "refund", order: "7", wantErr: ErrNoPayment},
+			},
+			wantBalance: "50.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+		{
+			name: "refunded payment before authorizations",
+			steps: []ledgerStep{
+				{op: "topup", amount: "50", key: "a"},
+				{op: "pay", order: "7", amount: "20"},
+				{op: "refund", order: "7"},
+				{op: "refund", order: "7"},
+			},
+			wantBalance: "50.00 USD",
+			wantHolds:   "0.00 USD",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			l := NewMemoryLedger()
+
+			for i, step := range tt.steps {
+				if err := step.apply(ctx, l); !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d %s = %v, want %v", i, step.op, err, step.wantErr)
+				}
+			}
+
+			if got := usdBalance(t, l.Balances, "1"); got != tt.wantBalance {
+				t.Errorf("balance = %s, want %s", got, tt.wantBalance)
+			}
+			if got := usdBalance(t, l.Holds, "1"); got != tt.wantHolds {
+				t.Errorf("holds = %s, want %s", got, tt.wantHolds)
+			}
+		})
+	}
+}
+
+func usdBalance(t *testing.T, get func(context.Context, string) ([]common.Money, error), customerId string) string {
+	t.Helper()
+
+	balances, err := get(context.Background(), customerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range balances {
+		if b.Currency == "USD" {
+			return b.String()
+		}
+	}
+	return common.Money{Currency: "USD"}.String()
+}
+
+func legacyPayment(customerId, orderId string, amount common.Money) *Transaction {
+	return &Transaction{
+		ID:         paymentID(orderId),
+		Kind:       transactionPayment,
+		CustomerID: customerId,
+		OrderID:    orderId,
+		Entries: []Entry{
+			{Account: customerAccount(customerId), Amount: negate(amount)},
+			{Account: paymentsAccount, Amount: amount},
+		},
+	}
+}
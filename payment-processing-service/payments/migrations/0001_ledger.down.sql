@@ -0,0 +1,3 @@
+drop table ledger_balances;
+drop table ledger_entries;
+drop table ledger_transactions;
@@ -0,0 +1,27 @@
+-- A ledger transaction moves money between accounts with entries that sum to zero
+create table ledger_transactions (
+	id varchar(255) primary key,
+	kind varchar(32) NOT NULL,
+	customer_id varchar(64) NOT NULL,
+	order_id varchar(64),
+	created_at timestamp NOT NULL
+);
+
+create table ledger_entries (
+	id BIGSERIAL primary key,
+	transaction_id varchar(255) NOT NULL references ledger_transactions(id),
+	account varchar(255) NOT NULL,
+	amount DECIMAL(14, 2) NOT NULL,
+	currency varchar(3) NOT NULL
+);
+
+create index ledger_entries_transaction_idx on ledger_entries (transaction_id);
+create index ledger_entries_account_idx on ledger_entries (account, currency);
+
+-- Balances are the sums of the entries of each account, kept up to date with every transaction
+create table ledger_balances (
+	account varchar(255) NOT NULL,
+	currency varchar(3) NOT NULL,
+	balance DECIMAL(14, 2) NOT NULL,
+	primary key (account, currency)
+);
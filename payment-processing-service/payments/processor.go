@@ -0,0 +1,307 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+// Decision is the outcome of a payment request
+type Decision struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func approve() Decision {
+	return Decision{Approved: true}
+}
+
+func decline(reason string) Decision {
+	return Decision{Reason: reason}
+}
+
+// PaymentProcessor decides the payments of orders in two steps. Authorize decides
+// whether the payment of a new order is approved and places a hold on it, Capture
+// takes the held payment when the order is fulfilled, and Void releases the hold
+// when the order is canceled. Refund pays back the captured payment of a paid order
+// that is canceled.
+//
+// Processors are used by several workers at the same time. A request that is
+// processed again, because its response could not be published, is not charged
+// or refunded twice. An error means no decision could be made, and the request is
+// retried.
+type PaymentProcessor interface {
+	Authorize(context.Context, common.PaymentRequest) (Decision, error)
+	Capture(context.Context, common.PaymentRequest) (Decision, error)
+	Void(context.Context, common.PaymentRequest) (Decision, error)
+	Refund(context.Context, common.PaymentRequest) (Decision, error)
+}
+
+// instantSettlement captures, voids and refunds the payments of processors that
+// do not hold money, they only decide authorizations
+type instantSettlement struct{}
+
+func (instantSettlement) Capture(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	return approve(), nil
+}
+
+func (instantSettlement) Void(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	return approve(), nil
+}
+
+func (instantSettlement) Refund(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	return approve(), nil
+}
+
+// ApproveProcessor approves every payment
+type ApproveProcessor struct {
+	instantSettlement
+}
+
+func (ApproveProcessor) Authorize(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	return approve(), nil
+}
+
+// ThresholdProcessor approves payments up to the limit of their currency
+// and declines payments in currencies without a limit
+type ThresholdProcessor struct {
+	instantSettlement
+	limits map[string]common.Money
+}
+
+func NewThresholdProcessor(limits map[string]common.Money) *ThresholdProcessor {
+	return &ThresholdProcessor{limits: limits}
+}
+
+func (p *ThresholdProcessor) Authorize(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	limit, ok := p.limits[req.TotalPrice.Currency]
+	if !ok {
+		return decline("Currency " + req.TotalPrice.Currency + " not supported"), nil
+	}
+
+	if cmp, _ := req.TotalPrice.Cmp(limit); cmp > 0 {
+		return decline("Insufficient funds"), nil
+	}
+	return approve(), nil
+}
+
+// RandomProcessor declines a share of the payments at random, like a gateway
+// declining cards. The decision is drawn from the order id, so a payment is
+// declined every time if it is declined once and nothing is kept per order.
+type RandomProcessor struct {
+	instantSettlement
+	failureRate float64
+	seed        uint64
+}
+
+func NewRandomProcessor(failureRate float64, seed int64) *RandomProcessor {
+	return &RandomProcessor{
+		failureRate: failureRate,
+		seed:        uint64(seed),
+	}
+}
+
+func (p *RandomProcessor) Authorize(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	if p.draw(req.OrderID) < p.failureRate {
+		return decline("Card declined"), nil
+	}
+	return approve(), nil
+}
+
+// draw returns a number in [0, 1) that is the same every time for the order
+func (p *RandomProcessor) draw(orderId string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(orderId))
+	x := h.Sum64() ^ p.seed
+
+	// The splitmix64 finalizer spreads consecutive order ids over the whole range
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+// LedgerProcessor approves payments covered by the balance of the customer in
+// the currency of the payment, and holds, captures and voids them in the ledger.
+// Every step is applied once, so a request processed again gets the same decision.
+type LedgerProcessor struct {
+	ledger Ledger
+}
+
+func NewLedgerProcessor(ledger Ledger) *LedgerProcessor {
+	return &LedgerProcessor{ledger: ledger}
+}
+
+func (p *LedgerProcessor) Authorize(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	if req.CustomerID == "" {
+		return decline("Unknown customer"), nil
+	}
+
+	_, err := p.ledger.Authorize(ctx, req.CustomerID, req.OrderID, req.TotalPrice)
+	switch {
+	case errors.Is(err, ErrInsufficientFunds):
+		return decline("Insufficient funds"), nil
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, common.ErrUnknownCurrency):
+		return decline("Invalid amount " + req.TotalPrice.String()), nil
+	case err != nil:
+		return Decision{}, err
+	}
+	return approve(), nil
+}
+
+// Refund returns the captured payment to the balance of the customer, as well as
+// payments debited in a single step before authorizations. Orders that were not
+// paid through the ledger, because they were paid while another processor was used,
+// have nothing to pay back.
+func (p *LedgerProcessor) Refund(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	_, err := p.ledger.Refund(ctx, req.OrderID)
+	switch {
+	case errors.Is(err, ErrNoPayment):
+		return approve(), nil
+	case errors.Is(err, ErrNoCapture):
+		return decline("No captured payment"), nil
+	case err != nil:
+		return Decision{}, err
+	}
+	return approve(), nil
+}
+
+func (p *LedgerProcessor) Capture(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	_, err := p.ledger.Capture(ctx, req.OrderID)
+	return settlementDecision(err)
+}
+
+// Void approves orders without a hold, as there is nothing to release
+func (p *LedgerProcessor) Void(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	_, err := p.ledger.Void(ctx, req.OrderID)
+	if errors.Is(err, ErrNoAuthorization) {
+		return approve(), nil
+	}
+	return settlementDecision(err)
+}
+
+func settlementDecision(err error) (Decision, error) {
+	switch {
+	case errors.Is(err, ErrNoAuthorization):
+		return decline("No authorization"), nil
+	case errors.Is(err, ErrAuthorizationSettled):
+		return decline("Authorization already settled"), nil
+	case err != nil:
+		return Decision{}, err
+	}
+	return approve(), nil
+}
+
+// ScriptedProcessor returns outcomes read from a JSON file, so tests can choose
+// the decision of each payment:
+//
+//	{
+//	    "orders":    {"23050093553270784": {"approved": true}},
+//	    "customers": {"2": {"approved": false, "reason": "Card expired"}},
+//	    "sequence":  [{"approved": true}, {"approved": false, "reason": "Card declined"}]
+//	}
+//
+// Outcomes for the order take precedence over outcomes for the customer. Other
+// payments get the outcomes of the sequence in turn, starting over at its end,
+// and are approved when there is no sequence.
+type ScriptedProcessor struct {
+	instantSettlement
+	script paymentScript
+
+	mu   sync.Mutex
+	next int
+
+	// decisions remembers the outcomes taken from the sequence for the latest
+	// orders, recent holds their ids in a ring to evict the oldest one
+	decisions map[string]Decision
+	recent    []string
+	oldest    int
+}
+
+// maxScriptedDecisions is the number of orders whose sequence outcome the scripted
+// processor remembers for requests processed again
+const maxScriptedDecisions = 10_000
+
+type paymentScript struct {
+	Orders    map[string]Decision `json:"orders"`
+	Customers map[string]Decision `json:"customers"`
+	Sequence  []Decision          `json:"sequence"`
+}
+
+func LoadScriptedProcessor(path string) (*ScriptedProcessor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payment script: %v", err)
+	}
+
+	var script paymentScript
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("failed to parse payment script %s: %v", path, err)
+	}
+
+	// Declined outcomes without a reason still explain where the decision came from
+	for _, outcomes := range []map[string]Decision{script.Orders, script.Customers} {
+		for key, decision := range outcomes {
+			outcomes[key] = withScriptReason(decision)
+		}
+	}
+	for i, decision := range script.Sequence {
+		script.Sequence[i] = withScriptReason(decision)
+	}
+
+	return &ScriptedProcessor{
+		script:    script,
+		decisions: make(map[string]Decision),
+	}, nil
+}
+
+func withScriptReason(decision Decision) Decision {
+	if !decision.Approved && decision.Reason == "" {
+		decision.Reason = "Declined by payment script"
+	}
+	return decision
+}
+
+func (p *ScriptedProcessor) Authorize(ctx context.Context, req common.PaymentRequest) (Decision, error) {
+	if decision, ok := p.script.Orders[req.OrderID]; ok {
+		return decision, nil
+	}
+	if decision, ok := p.script.Customers[req.CustomerID]; ok {
+		return decision, nil
+	}
+	if len(p.script.Sequence) == 0 {
+		return approve(), nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if decision, ok := p.decisions[req.OrderID]; ok {
+		return decision, nil
+	}
+
+	decision := p.script.Sequence[p.next%len(p.script.Sequence)]
+	p.next++
+	p.remember(req.OrderID, decision)
+	return decision, nil
+}
+
+// remember must be called with the lock held
+func (p *ScriptedProcessor) remember(orderId string, decision Decision) {
+	if len(p.recent) < maxScriptedDecisions {
+		p.recent = append(p.recent, orderId)
+	} else {
+		delete(p.decisions, p.recent[p.oldest])
+		p.recent[p.oldest] = orderId
+		p.oldest = (p.oldest + 1) % maxScriptedDecisions
+	}
+	p.decisions[orderId] = decision
+}
@@ -0,0 +1,278 @@
+package payments
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aayush993/go-order-management/common"
+)
+
+func money(t *testing.T, amount, currency string) common.Money {
+	t.Helper()
+	m, err := common.ParseMoney(amount, currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestThresholdProcessor(t *testing.T) {
+	processor := NewThresholdProcessor(map[string]common.Money{
+		"USD": money(t, "1000", "USD"),
+		"EUR": money(t, "900", "EUR"),
+	})
+
+	tests := []struct {
+		name  string
+		total common.Money
+		want  Decision
+	}{
+		{name: "below limit", total: money(t, "999.99", "USD"), want: approve()},
+		{name: "at limit", total: money(t, "1000", "USD"), want: approve()},
+		{name: "above limit", total: money(t, "1000.01", "USD"), want: decline("Insufficient funds")},
+		// Limits apply per currency, 950 USD is approved
+		{name: "limit of currency", total: money(t, "950", "EUR"), want: decline("Insufficient funds")},
+		{name: "currency without limit", total: money(t, "1", "JPY"), want: decline("Currency JPY not supported")},
+	}
+
+	for _, tt := range tests {
+		got, err := processor.Authorize(context.Background(), common.PaymentRequest{OrderID: "1", TotalPrice: tt.total})
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Authorize(%s) = %+v, %v, want %+v", tt.name, tt.total, got, err, tt.want)
+		}
+	}
+}
+
+func TestRandomProcessor(t *testing.T) {
+	tests := []struct {
+		name         string
+		failureRate  float64
+		wantDeclined func(declined int) bool
+	}{
+		{name: "never", failureRate: 0, wantDeclined: func(declined int) bool { return declined == 0 }},
+		{name: "always", failureRate: 1, wantDeclined: func(declined int) bool { return declined == 100 }},
+		{name: "some", failureRate: 0.5, wantDeclined: func(declined int) bool { return declined > 0 && declined < 100 }},
+	}
+
+	for _, tt := range tests {
+		processor := NewRandomProcessor(tt.failureRate, 1)
+		ctx := context.Background()
+
+		declined := 0
+		for i := 0; i < 100; i++ {
+			req := common.PaymentRequest{OrderID: strconv.Itoa(i), TotalPrice: money(t, "10", "USD")}
+			first, err := processor.Authorize(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A request processed again gets the same decision
+			if again, err := processor.Authorize(ctx, req); err != nil || again != first {
+				t.Errorf("%s: order %s decided %+v then %+v, %v", tt.name, req.OrderID, first, again, err)
+			}
+
+			if !first.Approved {
+				declined++
+				if first.Reason != "Card declined" {
+					t.Errorf("%s: declined with reason %q", tt.name, first.Reason)
+				}
+			}
+		}
+
+		if !tt.wantDeclined(declined) {
+			t.Errorf("%s: %d of 100 payments declined at failure rate %v", tt.name, declined, tt.failureRate)
+		}
+	}
+}
+
+func TestScriptedProcessor(t *testing.T) {
+	script := `{
+		"orders":    {"10": {"approved": true}, "11": {"approved": false}},
+		"customers": {"2": {"approved": false, "reason": "Card expired"}},
+		"sequence":  [{"approved": true}, {"approved": false, "reason": "Card declined"}]
+	}`
+	path := filepath.Join(t.TempDir(), "script.json")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	processor, err := LoadScriptedProcessor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests are processed in order, the sequence is shared by the requests without an outcome
+	tests := []struct {
+		name     string
+		orderId  string
+		customer string
+		want     Decision
+	}{
+		{name: "order outcome over customer outcome", orderId: "10", customer: "2", want: approve()},
+		{name: "declined without reason", orderId: "11", customer: "1", want: decline("Declined by payment script")},
+		{name: "customer outcome", orderId: "12", customer: "2", want: decline("Card expired")},
+		{name: "first of sequence", orderId: "13", customer: "1", want: approve()},
+		{name: "second of sequence", orderId: "14", customer: "1", want: decline("Card declined")},
+		{name: "processed again", orderId: "13", customer: "1", want: approve()},
+		{name: "sequence starts over", orderId: "15", customer: "1", want: approve()},
+	}
+
+	for _, tt := range tests {
+		req := common.PaymentRequest{OrderID: tt.orderId, CustomerID: tt.customer, TotalPrice: money(t, "10", "USD")}
+		got, err := processor.Authorize(context.Background(), req)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Authorize(order %s) = %+v, %v, want %+v", tt.name, tt.orderId, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadScriptedProcessor(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{name: "empty script", script: `{}`},
+		{name: "invalid json", script: `{"orders": [`, wantErr: true},
+		{name: "missing file", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, strconv.Itoa(i)+".json")
+		if tt.script != "" {
+			if err := os.WriteFile(path, []byte(tt.script), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		processor, err := LoadScriptedProcessor(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: LoadScriptedProcessor() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// Payments are approved when the script has no outcomes
+		if got, err := processor.Authorize(context.Background(), common.PaymentRequest{OrderID: "1"}); err != nil || !got.Approved {
+			t.Errorf("%s: Authorize() = %+v, %v, want approved", tt.name, got, err)
+		}
+	}
+}
+
+func TestLedgerProcessor(t *testing.T) {
+	ctx := context.Background()
+	ledger := NewMemoryLedger()
+	if _, err := ledger.TopUp(ctx, "1", money(t, "50", "USD"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ledger.post(legacyPayment("1", "11", money(t, "5", "USD"))); err != nil {
+		t.Fatal(err)
+	}
+	processor := NewLedgerProcessor(ledger)
+
+	// Requests are processed in order against the balance of customer 1
+	tests := []struct {
+		name        string
+		req         common.PaymentRequest
+		want        Decision
+		wantBalance string
+	}{
+		{
+			name:        "authorized",
+			req:         common.PaymentRequest{OrderID: "7", CustomerID: "1", TotalPrice: money(t, "30", "USD")},
+			want:        approve(),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "authorized again",
+			req:         common.PaymentRequest{OrderID: "7", CustomerID: "1", TotalPrice: money(t, "30", "USD")},
+			want:        approve(),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "insufficient funds",
+			req:         common.PaymentRequest{OrderID: "8", CustomerID: "1", TotalPrice: money(t, "30", "USD")},
+			want:        decline("Insufficient funds"),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "unknown customer",
+			req:         common.PaymentRequest{OrderID: "9", TotalPrice: money(t, "1", "USD")},
+			want:        decline("Unknown customer"),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "refund before capture",
+			req:         common.PaymentRequest{Type: common.PaymentRefund, OrderID: "7", CustomerID: "1"},
+			want:        decline("No captured payment"),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "captured",
+			req:         common.PaymentRequest{Type: common.PaymentCapture, OrderID: "7", CustomerID: "1"},
+			want:        approve(),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "void after capture",
+			req:         common.PaymentRequest{Type: common.PaymentVoid, OrderID: "7", CustomerID: "1"},
+			want:        decline("Authorization already settled"),
+			wantBalance: "15.00 USD",
+		},
+		{
+			name:        "refunded",
+			req:         common.PaymentRequest{Type: common.PaymentRefund, OrderID: "7", CustomerID: "1"},
+			want:        approve(),
+			wantBalance: "45.00 USD",
+		},
+		{
+			name:        "refunded again",
+			req:         common.PaymentRequest{Type: common.PaymentRefund, OrderID: "7", CustomerID: "1"},
+			want:        approve(),
+			wantBalance: "45.00 USD",
+		},
+		{
+			name:        "capture without authorization",
+			req:         common.PaymentRequest{Type: common.PaymentCapture, OrderID: "10", CustomerID: "1"},
+			want:        decline("No authorization"),
+			wantBalance: "45.00 USD",
+		},
+		{
+			// Voids of orders declined before their hold was placed have nothing to release
+			name:        "void without authorization",
+			req:         common.PaymentRequest{Type: common.PaymentVoid, OrderID: "10", CustomerID: "1"},
+			want:        approve(),
+			wantBalance: "45.00 USD",
+		},
+		{
+			// Confirmed before authorizations, paid in a single step
+			name:        "refunded payment before authorizations",
+			req:         common.PaymentRequest{Type: common.PaymentRefund, OrderID: "11", CustomerID: "1"},
+			want:        approve(),
+			wantBalance: "50.00 USD",
+		},
+		{
+			// Paid while another processor was used, nothing to pay back
+			name:        "refund without a payment",
+			req:         common.PaymentRequest{Type: common.PaymentRefund, OrderID: "12", CustomerID: "1"},
+			want:        approve(),
+			wantBalance: "50.00 USD",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := processPayment(ctx, processor, tt.req)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: decision = %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+		if balance := usdBalance(t, ledger.Balances, "1"); balance != tt.wantBalance {
+			t.Errorf("%s: balance = %s, want %s", tt.name, balance, tt.wantBalance)
+		}
+	}
+}
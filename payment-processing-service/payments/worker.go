@@ -0,0 +1,124 @@
+// Package payments holds the ledger, the payment processors and the worker
+// consuming payment requests, so they can be run by other services in tests.
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aayush993/go-order-management/common"
+	"github.com/streadway/amqp"
+)
+
+// approvedStatus is the response status of approved requests of each type
+var approvedStatus = map[string]string{
+	common.PaymentAuthorize: common.PaymentAuthorized,
+	common.PaymentCapture:   common.PaymentCaptured,
+	common.PaymentVoid:      common.PaymentVoided,
+	common.PaymentRefund:    common.PaymentRefunded,
+}
+
+// PaymentsWorker returns the consumer of payment requests of queueName. Responses are
+// published through mqSvc so the worker can run against RabbitMQ or the in-memory broker.
+// Requests that cannot be decoded or have an unknown type are dead-lettered, requests
+// the processor cannot decide and failed responses are retried.
+func PaymentsWorker(mqSvc common.MqSvc, queueName string, processor PaymentProcessor) func(<-chan amqp.Delivery) {
+	return func(msgs <-chan amqp.Delivery) {
+		// Requests taken from the queue are finished during shutdown, publishes
+		// are bounded by the confirm timeout of the broker
+		ctx := context.Background()
+
+		for d := range msgs {
+
+			var req common.PaymentRequest
+			requesId := d.CorrelationId
+
+			err := json.Unmarshal(d.Body, &req)
+			if err != nil {
+				log.Printf("[%s] Failed to decode message error: %v", requesId, err)
+				if err := mqSvc.DeadLetter(ctx, queueName, d, err); err != nil {
+					log.Printf("[%s] Failed to dead-letter payment request: %v", requesId, err)
+				}
+				continue
+			}
+
+			// Requests without a type are authorizations
+			if req.Type == "" {
+				req.Type = common.PaymentAuthorize
+			}
+			status, ok := approvedStatus[req.Type]
+			if !ok {
+				err := fmt.Errorf("unknown payment request type %q", req.Type)
+				log.Printf("[%s] Failed to process payment for order id: %v error: %v", requesId, req.OrderID, err)
+				if err := mqSvc.DeadLetter(ctx, queueName, d, err); err != nil {
+					log.Printf("[%s] Failed to dead-letter payment request: %v", requesId, err)
+				}
+				continue
+			}
+
+			decision, err := processPayment(ctx, processor, req)
+			if err != nil {
+				log.Printf("[%s] Failed to process payment for order id: %v error: %v", requesId, req.OrderID, err)
+				if err := mqSvc.Retry(ctx, queueName, d, err); err != nil {
+					log.Printf("[%s] Failed to retry payment request: %v", requesId, err)
+				}
+				continue
+			}
+
+			var res common.PaymentResponse
+			res.Type = req.Type
+			res.OrderID = req.OrderID
+
+			var message string
+			if decision.Approved {
+				message = "Payment " + status
+				res.PaymentStatus = status
+			} else {
+				res.PaymentStatus = common.PaymentFailed
+				res.Reason = decision.Reason
+				message = "Payment " + req.Type + " failed: " + decision.Reason
+			}
+
+			log.Printf("[%s] %s for order id: %v", requesId, message, req.OrderID)
+
+			// Publish payment response
+			body, err := json.Marshal(res)
+			if err != nil {
+				log.Printf("[%s] failed to marshal json: %v", requesId, err)
+				if err := mqSvc.DeadLetter(ctx, queueName, d, err); err != nil {
+					log.Printf("[%s] Failed to dead-letter payment request: %v", requesId, err)
+				}
+				continue
+			}
+
+			// Processors give a request processed again the same decision
+			err = mqSvc.Publish(ctx, d.ReplyTo, body, "", requesId)
+			if err != nil {
+				log.Printf("[%s] Failed to publish payment response: %v", requesId, err)
+				if err := mqSvc.Retry(ctx, queueName, d, err); err != nil {
+					log.Printf("[%s] Failed to retry payment request: %v", requesId, err)
+				}
+				continue
+			}
+
+			d.Ack(false)
+			log.Printf("[%s] Payment response published", requesId)
+		}
+	}
+}
+
+// processPayment passes the request to the step of the processor for its type
+func processPayment(ctx context.Context, processor PaymentProcessor, req common.PaymentRequest) (Decision, error) {
+	switch req.Type {
+	case common.PaymentCapture:
+		return processor.Capture(ctx, req)
+	case common.PaymentVoid:
+		return processor.Void(ctx, req)
+	case common.PaymentRefund:
+		return processor.Refund(ctx, req)
+	default:
+		return processor.Authorize(ctx, req)
+	}
+}
@@ -3,7 +3,7 @@ for ((i=1; ; i++)); do
     echo "Sending request $i..."
     
     # Send request using cURL
-    curl -X POST -H "Content-Type: application/json" -d '{"customerId": "1", "productId": "1", "quantity": 1}' "http://localhost:3000/orders"
+    curl -X POST -H "Content-Type: application/json" -d '{"customerId": "1", "items": [{"productId": "1", "quantity": 1}]}' "http://localhost:3000/orders"
     
     echo "Request $i completed."
 